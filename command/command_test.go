@@ -56,6 +56,23 @@ func matchCase(nocase bool) map[string]*patternMap {
 				"hello": true,
 				"ho":    true,
 			},
+			"a*": &patternMap{
+				"":  false,
+				"a": true,
+			},
+			"?": &patternMap{
+				"": false,
+			},
+			"[a-z]": &patternMap{
+				"": false,
+			},
+			"[^a]": &patternMap{
+				"": false,
+			},
+			"\\a": &patternMap{
+				"":  false,
+				"a": true,
+			},
 		}
 
 	} else {
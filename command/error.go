@@ -43,6 +43,42 @@ var (
 	// ErrInteger value is not an integer or out of range
 	ErrInteger = errors.New("ERR value is not an integer or out of range")
 
+	// ErrHashInteger hash value is not an integer
+	ErrHashInteger = errors.New("ERR hash value is not an integer")
+
+	// ErrHashFloat hash value is not a float
+	ErrHashFloat = errors.New("ERR hash value is not a float")
+
+	// ErrFloat value is not a valid float
+	ErrFloat = errors.New("ERR value is not a valid float")
+
+	// ErrIncrOverflow increment or decrement would overflow
+	ErrIncrOverflow = errors.New("ERR increment or decrement would overflow")
+
+	// ErrHashFull hash reaches the maximum number of fields
+	ErrHashFull = errors.New("ERR hash reaches the maximum number of fields")
+
+	// ErrFieldTooLong hash field is longer than allowed
+	ErrFieldTooLong = errors.New("ERR hash field is too long")
+
+	// ErrInvalidField hash field contains the key separator
+	ErrInvalidField = errors.New("ERR hash field contains the key separator")
+
+	// ErrHashValueTooLarge hash value is larger than allowed
+	ErrHashValueTooLarge = errors.New("ERR hash value is too large")
+
+	// ErrNoSuchField no field of the hash is fit for the request
+	ErrNoSuchField = errors.New("ERR no such field")
+
+	// ErrInvalidCursor cursor can not be decoded
+	ErrInvalidCursor = errors.New("ERR invalid cursor")
+
+	// ErrStaleCursor cursor was issued by an incompatible scan implementation
+	ErrStaleCursor = errors.New("ERR stale cursor, restart the scan")
+
+	// ErrScanLimit scan reads more keys than allowed
+	ErrScanLimit = errors.New("ERR scan reads more keys than allowed")
+
 	// ErrBitInteger bit is not an integer or out of range
 	ErrBitInteger = errors.New("ERR bit is not an integer or out of range")
 
@@ -3,15 +3,52 @@ package command
 import (
 	"errors"
 	"strconv"
+	"strings"
 
 	"github.com/meitu/titan/db"
+	"github.com/meitu/titan/encoding/resp"
 )
 
+// hashError returns the protocol error of an error of db, the errors about a field are reported without the field
+// like redis does. The other errors are returned as they are
+func hashError(err error) error {
+	if fe, ok := err.(*db.FieldError); ok {
+		err = fe.Err
+	}
+	switch err {
+	case db.ErrTypeMismatch:
+		return ErrTypeMismatch
+	case db.ErrNotAnInteger:
+		return ErrHashInteger
+	case db.ErrNotAFloat:
+		return ErrHashFloat
+	case db.ErrInteger:
+		return ErrIncrOverflow
+	case db.ErrHashFull:
+		return ErrHashFull
+	case db.ErrFieldTooLong:
+		return ErrFieldTooLong
+	case db.ErrInvalidField:
+		return ErrInvalidField
+	case db.ErrValueTooLarge:
+		return ErrHashValueTooLarge
+	case db.ErrFieldNotFound:
+		return ErrNoSuchField
+	case db.ErrInvalidCursor:
+		return ErrInvalidCursor
+	case db.ErrStaleCursor:
+		return ErrStaleCursor
+	case db.ErrScanLimitExceeded:
+		return ErrScanLimit
+	}
+	return err
+}
+
 // HDel removes the specified fields from the hash stored at key
 func HDel(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 	hash, err := txn.Hash([]byte(ctx.Args[0]))
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 
 	var fields [][]byte
@@ -20,7 +57,7 @@ func HDel(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 	}
 	c, err := hash.HDel(fields)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	return Integer(ctx.Out, c), nil
 }
@@ -33,12 +70,12 @@ func HSet(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 
 	status, err := hash.HSet(field, value)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	return Integer(ctx.Out, int64(status)), nil
 }
@@ -51,12 +88,12 @@ func HSetNX(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 
 	status, err := hash.HSetNX(field, value)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	return Integer(ctx.Out, int64(status)), nil
 }
@@ -68,11 +105,11 @@ func HGet(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	val, err := hash.HGet(field)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	if val == nil {
 		return NullBulkString(ctx.Out), nil
@@ -80,16 +117,16 @@ func HGet(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 	return BulkString(ctx.Out, string(val)), nil
 }
 
-// HGetAll returns all fields and values of the hash stored at key
+// HGetAll returns all fields and values of the hash stored at key in the byte-wise order of the fields
 func HGetAll(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 	key := []byte(ctx.Args[0])
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	fields, vals, err := hash.HGetAll()
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 
 	var results [][]byte
@@ -107,11 +144,11 @@ func HExists(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 	field := []byte(ctx.Args[1])
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	exist, err := hash.HExists(field)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	if exist {
 		return Integer(ctx.Out, 1), nil
@@ -125,17 +162,17 @@ func HIncrBy(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 	field := []byte(ctx.Args[1])
 	incr, err := strconv.ParseInt(ctx.Args[2], 10, 64)
 	if err != nil {
-		return nil, err
+		return nil, ErrInteger
 	}
 
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 
 	val, err := hash.HIncrBy(field, incr)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	return Integer(ctx.Out, val), err
 }
@@ -147,17 +184,17 @@ func HIncrByFloat(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 	field := []byte(ctx.Args[1])
 	incr, err := strconv.ParseFloat(ctx.Args[2], 64)
 	if err != nil {
-		return nil, err
+		return nil, ErrFloat
 	}
 
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 
 	val, err := hash.HIncrByFloat(field, incr)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	return BulkString(ctx.Out, strconv.FormatFloat(val, 'f', -1, 64)), nil
 }
@@ -167,11 +204,11 @@ func HKeys(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 	key := []byte(ctx.Args[0])
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	fields, _, err := hash.HGetAll()
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	return BytesArray(ctx.Out, fields), nil
 }
@@ -181,11 +218,11 @@ func HVals(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 	key := []byte(ctx.Args[0])
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	_, vals, err := hash.HGetAll()
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	return BytesArray(ctx.Out, vals), nil
 
@@ -196,7 +233,7 @@ func HLen(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 	key := []byte(ctx.Args[0])
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	return Integer(ctx.Out, hash.HLen()), nil
 }
@@ -207,11 +244,11 @@ func HStrLen(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 	field := []byte(ctx.Args[1])
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	val, err := hash.HGet(field)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	return Integer(ctx.Out, int64(len(val))), nil
 }
@@ -226,12 +263,12 @@ func HMGet(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 
 	vals, err := hash.HMGet(fields)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	return BytesArray(ctx.Out, vals), nil
 }
@@ -257,11 +294,64 @@ func HMSet(ctx *Context, txn *db.Transaction) (OnCommit, error) {
 
 	hash, err := txn.Hash(key)
 	if err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 
 	if err := hash.HMSet(fields, values); err != nil {
-		return nil, err
+		return nil, hashError(err)
 	}
 	return SimpleString(ctx.Out, "OK"), nil
 }
+
+// HScan incrementally iterates over the fields and values of the hash stored at key
+func HScan(ctx *Context, txn *db.Transaction) (OnCommit, error) {
+	var (
+		key     = []byte(ctx.Args[0])
+		count   = int64(defaultScanCount)
+		pattern []byte
+		err     error
+	)
+	cursor, err := db.ParseHScanCursor([]byte(ctx.Args[1]))
+	if err != nil {
+		return nil, hashError(err)
+	}
+
+	if len(ctx.Args)%2 != 0 {
+		return nil, ErrSyntax
+	}
+	for i := 2; i < len(ctx.Args); i += 2 {
+		arg := strings.ToLower(ctx.Args[i])
+		next := ctx.Args[i+1]
+		switch arg {
+		case "count":
+			if count, err = strconv.ParseInt(next, 10, 64); err != nil || count < 0 {
+				return nil, ErrInteger
+			}
+			if count > ScanMaxCount {
+				count = ScanMaxCount
+			}
+		case "match":
+			pattern = []byte(next)
+		default:
+			return nil, ErrSyntax
+		}
+	}
+
+	hash, err := txn.Hash(key)
+	if err != nil {
+		return nil, hashError(err)
+	}
+	next, fields, vals, err := hash.HScan(cursor, pattern, count)
+	if err != nil {
+		return nil, hashError(err)
+	}
+	return func() {
+		resp.ReplyArray(ctx.Out, 2)
+		resp.ReplyBulkString(ctx.Out, string(next.Bytes()))
+		resp.ReplyArray(ctx.Out, 2*len(fields))
+		for i := range fields {
+			resp.ReplyBulkString(ctx.Out, string(fields[i]))
+			resp.ReplyBulkString(ctx.Out, string(vals[i]))
+		}
+	}, nil
+}
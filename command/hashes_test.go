@@ -0,0 +1,127 @@
+package command
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+
+	"github.com/meitu/titan/db"
+	"github.com/stretchr/testify/assert"
+)
+
+// hscanTest runs HSCAN and returns the next cursor and the fields of the reply
+func hscanTest(t *testing.T, args ...string) (string, []string) {
+	lines := ctxLines(CallTest("hscan", args...))
+	if !assert.True(t, len(lines) >= 4, "%q", lines) || !assert.Equal(t, "*2", lines[0]) {
+		return "", nil
+	}
+	var fields []string
+	// the bulk strings of the fields and values follow the cursor and the array header
+	for i := 5; i+3 < len(lines); i += 4 {
+		fields = append(fields, lines[i])
+	}
+	return lines[2], fields
+}
+
+func TestHScan(t *testing.T) {
+	key := "hscan-command"
+	for _, f := range []string{"f0", "f1", "f2", "f3", "x0"} {
+		CallTest("hset", key, f, "v"+f)
+	}
+
+	// the cursor resumes the scan until it is 0
+	var fields []string
+	cursor := "0"
+	for calls := 0; calls < 10; calls++ {
+		var fs []string
+		cursor, fs = hscanTest(t, key, cursor, "COUNT", "2")
+		assert.True(t, len(fs) <= 2)
+		fields = append(fields, fs...)
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, "0", cursor)
+	sort.Strings(fields)
+	assert.Equal(t, []string{"f0", "f1", "f2", "f3", "x0"}, fields)
+
+	cursor, fields = hscanTest(t, key, "0", "MATCH", "f[0-1]", "COUNT", "10")
+	assert.Equal(t, "0", cursor)
+	assert.Equal(t, []string{"f0", "f1"}, fields)
+
+	// COUNT bounds the fields examined, so a sparse MATCH returns a cursor before the hash is walked
+	cursor, fields = hscanTest(t, key, "0", "MATCH", "*x0", "COUNT", "2")
+	assert.NotEqual(t, "0", cursor)
+	assert.Empty(t, fields)
+
+	assert.Equal(t, ErrInvalidCursor.Error(), ctxLines(CallTest("hscan", key, "bogus"))[0][1:])
+	assert.Equal(t, ErrInteger.Error(), ctxLines(CallTest("hscan", key, "0", "COUNT", "-1"))[0][1:])
+	assert.Equal(t, ErrSyntax.Error(), ctxLines(CallTest("hscan", key, "0", "LIMIT", "1"))[0][1:])
+}
+
+func TestHScanSharedPrefix(t *testing.T) {
+	key := "hscan-shared-prefix"
+	var want []string
+	for i := 0; i < 50; i++ {
+		f := fmt.Sprintf("session:%04d", i)
+		CallTest("hset", key, f, "v")
+		want = append(want, f)
+	}
+
+	// the cursor keeps the whole field, so every call stops at COUNT and no field is returned twice
+	var fields []string
+	cursor := "0"
+	for calls := 0; calls < 10; calls++ {
+		var fs []string
+		cursor, fs = hscanTest(t, key, cursor, "COUNT", "10")
+		assert.Len(t, fs, 10)
+		fields = append(fields, fs...)
+		if cursor == "0" {
+			break
+		}
+	}
+	assert.Equal(t, "0", cursor)
+	assert.Equal(t, want, fields)
+}
+
+func TestHScanStaleCursor(t *testing.T) {
+	key := "hscan-stale-cursor"
+	for _, f := range []string{"a", "b", "c"} {
+		CallTest("hset", key, f, "v")
+	}
+	cursor, _ := hscanTest(t, key, "0", "COUNT", "1")
+	assert.NotEqual(t, "0", cursor)
+
+	// a cursor of the hash deleted and recreated at the key is refused
+	CallTest("del", key)
+	CallTest("hset", key, "a", "v")
+	assert.Equal(t, ErrStaleCursor.Error(), ctxLines(CallTest("hscan", key, cursor))[0][1:])
+}
+
+func TestHIncrByErrors(t *testing.T) {
+	key := "hincrby-errors"
+	CallTest("hset", key, "s", "abc")
+	reply := func(args ...string) string {
+		return ctxLines(CallTest(args[0], args[1:]...))[0]
+	}
+
+	assert.Equal(t, "-"+ErrHashInteger.Error(), reply("hincrby", key, "s", "1"))
+	assert.Equal(t, "-"+ErrInteger.Error(), reply("hincrby", key, "n", "one"))
+	assert.Equal(t, ":1", reply("hincrby", key, "n", "1"))
+	CallTest("hset", key, "max", "9223372036854775807")
+	assert.Equal(t, "-"+ErrIncrOverflow.Error(), reply("hincrby", key, "max", "1"))
+
+	assert.Equal(t, "-"+ErrHashFloat.Error(), reply("hincrbyfloat", key, "s", "1.5"))
+	assert.Equal(t, "-"+ErrFloat.Error(), reply("hincrbyfloat", key, "n", "half"))
+
+	db.SetMaxFieldLen(4)
+	defer db.SetMaxFieldLen(0)
+	assert.Equal(t, "-"+ErrFieldTooLong.Error(), reply("hset", key, "too-long", "v"))
+	assert.Equal(t, "-"+ErrFieldTooLong.Error(), reply("hincrby", key, "too-long", "1"))
+	assert.Equal(t, "-"+ErrFieldTooLong.Error(), reply("hincrbyfloat", key, "too-long", "1.5"))
+
+	db.SetStrictFields(true)
+	defer db.SetStrictFields(false)
+	assert.Equal(t, "-"+ErrInvalidField.Error(), reply("hset", key, "a:b", "v"))
+	assert.Equal(t, "-"+ErrInvalidField.Error(), reply("hmset", key, "ok", "v", "a:b", "v"))
+}
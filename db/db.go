@@ -14,6 +14,7 @@ import (
 	"github.com/meitu/titan/conf"
 	"github.com/meitu/titan/db/store"
 	"github.com/meitu/titan/metrics"
+	"github.com/pingcap/tidb/kv"
 )
 
 var (
@@ -38,6 +39,72 @@ var (
 	// ErrEncodingMismatch object encoding type
 	ErrEncodingMismatch = errors.New("error object encoding type")
 
+	// ErrFieldNotFound no field of a hash is fit for the request
+	ErrFieldNotFound = errors.New("field not found")
+
+	// ErrNotAnInteger the value of a hash field is not an integer
+	ErrNotAnInteger = errors.New("hash value is not an integer")
+
+	// ErrNotAFloat the value of a hash field is not a float
+	ErrNotAFloat = errors.New("hash value is not a float")
+
+	// ErrHashFull the hash holds the most fields allowed
+	ErrHashFull = errors.New("hash reaches the maximum number of fields")
+
+	// ErrFieldTooLong field is longer than allowed
+	ErrFieldTooLong = errors.New("field is too long")
+
+	// ErrInvalidField field contains the key separator
+	ErrInvalidField = errors.New("field contains the key separator")
+
+	// ErrLabelsTooLarge labels of an object are larger than allowed
+	ErrLabelsTooLarge = errors.New("labels are too large")
+
+	// ErrValueTooLarge the value is larger than allowed
+	ErrValueTooLarge = errors.New("value is too large")
+
+	// ErrScanLimitExceeded the scan needs to read more keys than allowed
+	ErrScanLimitExceeded = errors.New("scan reads more keys than allowed")
+
+	// ErrLengthMismatch the number of fields does not match the number of values
+	ErrLengthMismatch = errors.New("fields and values length mismatch")
+
+	// ErrInsertionOrderDisabled the insertion order of the hash is not indexed
+	ErrInsertionOrderDisabled = errors.New("insertion order is not enabled")
+
+	// ErrVersioningDisabled the versions of the fields are not counted
+	ErrVersioningDisabled = errors.New("versioning is not enabled")
+
+	// ErrFieldTimesDisabled the times of the writes of the fields are not recorded
+	ErrFieldTimesDisabled = errors.New("field timestamps are not enabled")
+
+	// ErrInvalidCursor cursor can not be decoded
+	ErrInvalidCursor = errors.New("invalid cursor")
+
+	// ErrStaleCursor cursor was issued by an incompatible scan implementation
+	ErrStaleCursor = errors.New("stale cursor, restart the scan")
+
+	// ErrCorruptedValue stored value has an unknown encoding
+	ErrCorruptedValue = errors.New("corrupted value")
+
+	// ErrCorruptField stored key is not laid out as the item key of a field
+	ErrCorruptField = errors.New("corrupted field key")
+
+	// ErrDuplicateValue value is held by another field of a hash with unique values
+	ErrDuplicateValue = errors.New("value is held by another field")
+
+	// ErrLenMismatch the number of fields found differs from the length kept in the meta
+	ErrLenMismatch = errors.New("hash length does not match its fields")
+
+	// ErrInvalidJSONPath path is not of the syntax accepted by HGetAllJSONPath
+	ErrInvalidJSONPath = errors.New("invalid JSON path")
+
+	// ErrInvalidPrefix namespace or DB ID contains the key separator
+	ErrInvalidPrefix = errors.New("namespace or DB contains the key separator")
+
+	// ErrInvalidUTF8 field can not be a key of a JSON object
+	ErrInvalidUTF8 = errors.New("field is not valid UTF-8")
+
 	// IsErrNotFound returns true if the key is not found, otherwise return false
 	IsErrNotFound = store.IsErrNotFound
 
@@ -75,6 +142,18 @@ func toDBID(v []byte) DBID {
 	return DBID(id)
 }
 
+// iterErr returns the error recorded by the iterator if the store exposes one,
+// so that an iterator invalidated by a store-side error is not mistaken for
+// the end of the range
+func iterErr(iter Iterator) error {
+	if e, ok := iter.(interface {
+		Err() error
+	}); ok {
+		return e.Err()
+	}
+	return nil
+}
+
 // BatchGetValues issues batch requests to get values
 func BatchGetValues(txn *Transaction, keys [][]byte) ([][]byte, error) {
 	kvs, err := store.BatchGetValues(txn.t, keys)
@@ -125,10 +204,62 @@ func (rds *RedisStore) Close() error {
 	return rds.Close()
 }
 
+// WriteOp is the kind of a write
+type WriteOp int
+
+// Write operations passed to WriteInterceptor
+const (
+	WriteSet WriteOp = iota
+	WriteDelete
+)
+
+// WriteInterceptor observes the writes of data structures before they reach the store,
+// returning an error aborts the write and the command
+type WriteInterceptor interface {
+	// BeforeWrite is called with the store key and the value to be written, value is nil for deletes
+	BeforeWrite(op WriteOp, key, value []byte) error
+}
+
 // Transaction supplies transaction for data structures
 type Transaction struct {
-	t  store.Transaction
-	db *DB
+	t           store.Transaction
+	db          *DB
+	interceptor WriteInterceptor
+	// written counts the keys set or deleted through t
+	written int64
+}
+
+// WrittenKeys returns the number of store keys set or deleted through the transaction, including the metas,
+// the expire keys and the GC keys. A key written twice is counted twice
+func (txn *Transaction) WrittenKeys() int64 {
+	return txn.written
+}
+
+// countedTxn counts the keys set or deleted through the store transaction
+type countedTxn struct {
+	store.Transaction
+	n *int64
+}
+
+func (c countedTxn) Set(k kv.Key, v []byte) error {
+	if err := c.Transaction.Set(k, v); err != nil {
+		return err
+	}
+	*c.n++
+	return nil
+}
+
+func (c countedTxn) Delete(k kv.Key) error {
+	if err := c.Transaction.Delete(k); err != nil {
+		return err
+	}
+	*c.n++
+	return nil
+}
+
+// SetWriteInterceptor intercepts the hash writes of the transaction with w, nil removes the interceptor
+func (txn *Transaction) SetWriteInterceptor(w WriteInterceptor) {
+	txn.interceptor = w
 }
 
 // Begin a transaction
@@ -137,7 +268,22 @@ func (db *DB) Begin() (*Transaction, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Transaction{t: txn, db: db}, nil
+	t := &Transaction{db: db}
+	t.t = countedTxn{Transaction: txn, n: &t.written}
+	return t, nil
+}
+
+// keySeparator is the Separator checked against the key prefixes, tests replace it to break the invariant
+var keySeparator = []byte(Separator)
+
+// checkPrefix returns a *KeyError wrapping ErrInvalidPrefix if the namespace or the ID of the DB contains the
+// key separator, then the prefix of the DB also starts the keys of another namespace and its scans read them.
+// The object IDs are not checked, they are of a fixed length so the data key of an object is a prefix of no other
+func (db *DB) checkPrefix() error {
+	if bytes.Contains([]byte(db.Namespace), keySeparator) || bytes.Contains(db.ID.Bytes(), keySeparator) {
+		return &KeyError{Key: db.Prefix(), Err: ErrInvalidPrefix}
+	}
+	return nil
 }
 
 // Prefix returns the prefix of a DB object
@@ -133,6 +133,7 @@ func runExpire(db *DB) {
 		txn.Rollback()
 		return
 	}
+	defer iter.Close()
 	limit := expireBatchLimit
 	now := time.Now().UnixNano()
 	for iter.Valid() && iter.Key().HasPrefix(expireKeyPrefix) && limit > 0 {
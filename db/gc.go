@@ -1,11 +1,15 @@
 package db
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/meitu/titan/db/store"
 	"github.com/meitu/titan/metrics"
+	"github.com/pingcap/tidb/kv"
 	"go.uber.org/zap"
 )
 
@@ -19,6 +23,67 @@ const (
 	sysGCLeaseFlushInterval = 10
 )
 
+// gcLimiter is a token bucket spacing out the prefixes added to GC, it allows rate prefixes per second with
+// bursts of at most burst prefixes. A rate of 0 removes the limit
+type gcLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// gcRate is unlimited until SetGCRate is called
+var gcRate = &gcLimiter{now: time.Now, sleep: time.Sleep}
+
+// SetGCRate limits the destroyed objects to add at most rate prefixes per second to GC with bursts of burst
+// prefixes, so that destroying many large objects at once does not saturate the store. A rate of 0 removes the limit
+func SetGCRate(rate, burst int) {
+	gcRate.set(float64(rate), float64(burst))
+}
+
+func (l *gcLimiter) set(rate, burst float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if burst < 1 {
+		burst = 1
+	}
+	l.rate, l.burst, l.tokens, l.last = rate, burst, burst, l.now()
+}
+
+// reserve takes n tokens and returns how long the caller has to wait for them. The tokens may go negative,
+// so a large charge delays the following ones
+func (l *gcLimiter) reserve(n float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	now := l.now()
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+	}
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= n
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// wait charges n prefixes and blocks until they are paid for, it does not hold the lock while sleeping
+func (l *gcLimiter) wait(n float64) {
+	if d := l.reserve(n); d > 0 {
+		l.sleep(d)
+	}
+}
+
 func toTikvGCKey(key []byte) []byte {
 	b := []byte{}
 	b = append(b, sysNamespace...)
@@ -31,6 +96,7 @@ func toTikvGCKey(key []byte) []byte {
 // {sys.ns}:{sys.id}:{GC}:{prefix}
 // prefix: {user.ns}:{user.id}:{M/D}:{user.objectID}
 func gc(txn store.Transaction, prefix []byte) error {
+	gcRate.wait(1)
 	zap.L().Debug("add to gc", zap.ByteString("prefix", prefix))
 	metrics.GetMetrics().GCKeysCounterVec.WithLabelValues("add").Inc()
 	return txn.Set(toTikvGCKey(prefix), []byte{0})
@@ -137,6 +203,115 @@ func doGC(db *DB, limit int64) error {
 	return nil
 }
 
+// OrphanReport describes the data of an object which has no meta any more
+type OrphanReport struct {
+	// ID is the object ID
+	ID []byte
+	// Prefix is the data key prefix of the object
+	Prefix []byte
+}
+
+// metaObjectID returns the object ID of a meta, hashes and sets are encoded in json
+func metaObjectID(meta []byte) []byte {
+	if len(meta) > 0 && meta[0] == '{' {
+		var obj Object
+		if err := json.Unmarshal(meta, &obj); err == nil {
+			return obj.ID
+		}
+	}
+	obj, err := DecodeObject(meta)
+	if err != nil {
+		return nil
+	}
+	return obj.ID
+}
+
+// FindOrphanData samples at most limit data key prefixes of the db which are not being collected by GC and
+// reports those whose object ID has no live meta, limit <= 0 means no limitation. Metas are keyed by the user
+// key, so the sampled IDs are looked up by a single pass over the metas which stops once all of them are found
+func FindOrphanData(txn *Transaction, limit int) ([]OrphanReport, error) {
+	var sampled [][]byte
+	candidates := make(map[string]bool)
+	dprefix := DataKey(txn.db, nil)
+	ditr, err := txn.t.Seek(dprefix)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { ditr.Close() }()
+	for ditr.Valid() && ditr.Key().HasPrefix(dprefix) && (limit <= 0 || len(sampled) < limit) {
+		key := ditr.Key()
+		if len(key) < len(dprefix)+uuidLen {
+			if err := ditr.Next(); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		id := []byte(key[len(dprefix) : len(dprefix)+uuidLen])
+		prefix := DataKey(txn.db, id)
+		_, err := txn.t.Get(toTikvGCKey(prefix))
+		if err != nil && !IsErrNotFound(err) {
+			return nil, err
+		}
+		if IsErrNotFound(err) {
+			sampled = append(sampled, id)
+			candidates[string(id)] = true
+		}
+
+		// skip the rest keys of the object
+		next, err := txn.t.Seek(kv.Key(prefix).PrefixNext())
+		if err != nil {
+			return nil, err
+		}
+		ditr.Close()
+		ditr = next
+	}
+	if err := iterErr(ditr); err != nil {
+		return nil, err
+	}
+	if len(sampled) == 0 {
+		return nil, nil
+	}
+
+	mprefix := MetaKey(txn.db, nil)
+	iter, err := txn.t.Seek(mprefix)
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	for len(candidates) > 0 && iter.Valid() && iter.Key().HasPrefix(mprefix) {
+		if id := metaObjectID(iter.Value()); id != nil {
+			delete(candidates, string(id))
+		}
+		if err := iter.Next(); err != nil {
+			return nil, err
+		}
+	}
+	if err := iterErr(iter); err != nil {
+		return nil, err
+	}
+
+	var reports []OrphanReport
+	for _, id := range sampled {
+		if candidates[string(id)] {
+			reports = append(reports, OrphanReport{ID: id, Prefix: DataKey(txn.db, id)})
+		}
+	}
+	return reports, nil
+}
+
+// ReclaimOrphanData adds the orphan data reported by FindOrphanData to GC
+func ReclaimOrphanData(txn *Transaction, reports []OrphanReport) error {
+	for _, r := range reports {
+		if !bytes.HasPrefix(r.Prefix, DataKey(txn.db, nil)) {
+			continue
+		}
+		if err := gc(txn.t, r.Prefix); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // StartGC start gc
 //1.获取leader许可
 //2.leader 执行清理任务
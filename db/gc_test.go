@@ -0,0 +1,170 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/meitu/titan/db/store"
+	"github.com/pingcap/tidb/kv"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindOrphanData(t *testing.T) {
+	db := MockDB()
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	live, err := txn.Hash([]byte("live"))
+	assert.NoError(t, err)
+	assert.NoError(t, live.HMSet([][]byte{[]byte("f")}, [][]byte{[]byte("v")}))
+	orphan, err := txn.Hash([]byte("orphan"))
+	assert.NoError(t, err)
+	assert.NoError(t, orphan.HMSet([][]byte{[]byte("f1"), []byte("f2")}, [][]byte{[]byte("v1"), []byte("v2")}))
+	set, err := txn.Set([]byte("set"))
+	assert.NoError(t, err)
+	_, err = set.SAdd([][]byte{[]byte("m")})
+	assert.NoError(t, err)
+	// drop the meta without adding the data to GC
+	assert.NoError(t, txn.t.Delete(MetaKey(db, []byte("orphan"))))
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = db.Begin()
+	assert.NoError(t, err)
+	want := []OrphanReport{{ID: orphan.meta.ID, Prefix: DataKey(db, orphan.meta.ID)}}
+	// only the first limit data prefixes are sampled
+	for limit := 1; limit < 3; limit++ {
+		reports, err := FindOrphanData(txn, limit)
+		assert.NoError(t, err)
+		if len(reports) > 0 {
+			assert.Equal(t, want, reports)
+		}
+	}
+	reports, err := FindOrphanData(txn, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, want, reports)
+	reports, err = FindOrphanData(txn, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, want, reports)
+	assert.NoError(t, ReclaimOrphanData(txn, reports))
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = db.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	reports, err = FindOrphanData(txn, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, reports)
+
+	// a failing iterator is reported instead of a partial result
+	for _, prefix := range [][]byte{MetaKey(db, nil), DataKey(db, nil)} {
+		prefix := prefix
+		txn.t = &faultTxn{Transaction: txn.t, seek: func(t store.Transaction, k kv.Key) (kv.Iterator, error) {
+			iter, err := t.Seek(k)
+			if err != nil || !k.HasPrefix(prefix) {
+				return iter, err
+			}
+			return &faultIter{Iterator: iter, invalid: true, err: errInjected}, nil
+		}}
+		reports, err = FindOrphanData(txn, 0)
+		assert.Equal(t, errInjected, err)
+		assert.Nil(t, reports)
+		txn.t = txn.t.(*faultTxn).Transaction
+	}
+}
+
+// fakeClock advances only when slept on
+type fakeClock struct {
+	t     time.Time
+	slept time.Duration
+}
+
+func (c *fakeClock) now() time.Time { return c.t }
+
+func (c *fakeClock) sleep(d time.Duration) {
+	c.t = c.t.Add(d)
+	c.slept += d
+}
+
+func TestGCLimiter(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	l := &gcLimiter{now: clock.now}
+	l.sleep = func(d time.Duration) {
+		// the lock is released while sleeping, so another goroutine can take it
+		locked := make(chan struct{})
+		go func() {
+			l.mu.Lock()
+			l.mu.Unlock()
+			close(locked)
+		}()
+		select {
+		case <-locked:
+		case <-time.After(time.Second):
+			t.Error("the lock is held while sleeping")
+		}
+		clock.sleep(d)
+	}
+	l.set(5, 2)
+
+	// the burst passes at once, the rest is spaced by the rate
+	for i := 0; i < 10; i++ {
+		l.wait(1)
+	}
+	assert.Equal(t, 1600*time.Millisecond, clock.slept)
+
+	// idle time refills the bucket up to the burst
+	clock.t = clock.t.Add(time.Hour)
+	clock.slept = 0
+	l.wait(1)
+	l.wait(1)
+	assert.Equal(t, time.Duration(0), clock.slept)
+	l.wait(1)
+	assert.Equal(t, 200*time.Millisecond, clock.slept)
+
+	// a charge beyond the burst is paid for at once
+	clock.t = clock.t.Add(time.Hour)
+	clock.slept = 0
+	l.wait(12)
+	assert.Equal(t, 2*time.Second, clock.slept)
+
+	l.set(0, 0)
+	clock.slept = 0
+	for i := 0; i < 10; i++ {
+		l.wait(1)
+	}
+	assert.Equal(t, time.Duration(0), clock.slept)
+}
+
+func TestGCRate(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(0, 0)}
+	saved := gcRate
+	gcRate = &gcLimiter{now: clock.now, sleep: clock.sleep}
+	defer func() { gcRate = saved }()
+	SetGCRate(10, 1)
+
+	db := MockDB()
+	txn, err := db.Begin()
+	assert.NoError(t, err)
+	// 5 prefixes of 15 keys, the limiter is charged per prefix, the first one in the burst
+	for i := 0; i < 5; i++ {
+		hash, err := txn.Hash([]byte(fmt.Sprintf("gc-rate-%d", i)))
+		assert.NoError(t, err)
+		for j := 0; j <= i; j++ {
+			_, err := hash.HSet([]byte(fmt.Sprintf("f%d", j)), []byte("v"))
+			assert.NoError(t, err)
+		}
+		assert.NoError(t, hash.Destory())
+	}
+	assert.NoError(t, txn.Commit(context.TODO()))
+	assert.Equal(t, 400*time.Millisecond, clock.slept)
+
+	// deleting the keys is not limited, so the GC lease is never held while sleeping
+	assert.NoError(t, doGC(db, sysGCBurst))
+	assert.Equal(t, 400*time.Millisecond, clock.slept)
+	txn, err = db.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	prefix, err := gcGetPrefix(txn.t)
+	assert.NoError(t, err)
+	assert.Nil(t, prefix)
+}
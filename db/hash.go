@@ -1,14 +1,180 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/golang/snappy"
+	"github.com/meitu/titan/db/store"
+	"github.com/meitu/titan/metrics"
+	"github.com/pingcap/tidb/kv"
+	"go.uber.org/zap"
+)
+
+const (
+	// hscanCursorVersion is bumped whenever the position encoded in a cursor changes
+	hscanCursorVersion = 2
+
+	defaultHScanCount = 10
+
+	// hashLabelsMaxBytes bounds the total size of the keys and values of the labels of a hash
+	hashLabelsMaxBytes = 1024
+
+	// hsetRangeMaxSize is the largest value HSetRange makes, as the 512MB limit of SETRANGE in redis
+	hsetRangeMaxSize = 512 << 20
+)
+
+// maxHashFields is the most fields a hash can hold, 0 means unlimited
+var maxHashFields int64
+
+// SetMaxHashFields limits the number of fields of a hash to n, adding a field to a full hash fails with
+// ErrHashFull while the existing fields can still be overwritten. 0 removes the limit
+func SetMaxHashFields(n int64) {
+	maxHashFields = n
+}
+
+// checkMaxFields returns ErrHashFull if adding n fields exceeds the limit of SetMaxHashFields
+func (hash *Hash) checkMaxFields(n int64) error {
+	if maxHashFields > 0 && n > 0 && hash.meta.Len+n > maxHashFields {
+		return ErrHashFull
+	}
+	return nil
+}
+
+// maxValueSize is the largest value a field can hold, 0 means unlimited
+var maxValueSize int
+
+// SetMaxValueSize limits the size of a field value to n bytes, writing a larger value fails with
+// ErrValueTooLarge. 0 removes the limit
+func SetMaxValueSize(n int) {
+	maxValueSize = n
+}
+
+// maxFieldLen is the longest field a hash can hold, 0 means unlimited
+var maxFieldLen int
+
+// SetMaxFieldLen limits the length of a field to n bytes, writing a longer field fails with ErrFieldTooLong
+// before anything is written. 0 removes the limit
+func SetMaxFieldLen(n int) {
+	maxFieldLen = n
+}
+
+// strictFields makes the writes refuse the fields containing the Separator
+var strictFields bool
+
+// SetStrictFields makes writing a field which contains the Separator fail with ErrInvalidField before anything
+// is written, see IsValidField. It is off by default as the hashes written before may hold such fields
+func SetStrictFields(on bool) {
+	strictFields = on
+}
+
+// checkFields returns ErrFieldTooLong if any of fields exceeds the limit of SetMaxFieldLen, or ErrInvalidField
+// if any of them contains the Separator while SetStrictFields is on
+func checkFields(fields ...[]byte) error {
+	for _, field := range fields {
+		if maxFieldLen > 0 && len(field) > maxFieldLen {
+			return ErrFieldTooLong
+		}
+		if strictFields && !IsValidField(field) {
+			return ErrInvalidField
+		}
+	}
+	return nil
+}
+
+// checkValueSize returns ErrValueTooLarge if any of values exceeds the limit of SetMaxValueSize
+func checkValueSize(values ...[]byte) error {
+	if maxValueSize <= 0 {
+		return nil
+	}
+	for _, value := range values {
+		if len(value) > maxValueSize {
+			return ErrValueTooLarge
+		}
+	}
+	return nil
+}
+
+// maxScanKeys is the most keys a scan of a hash reads, 0 means unlimited
+var maxScanKeys int64
+
+// SetMaxScanKeys limits the keys read by any single scan of a hash, e.g. HGetAll, HScan or the count of
+// HLenVerified, to n. A scan needing more keys fails with ErrScanLimitExceeded. 0 removes the limit
+func SetMaxScanKeys(n int64) {
+	maxScanKeys = n
+}
+
+// scanKey counts a key read by a scan which has read n keys before, it fails once the limit is exceeded
+func scanKey(n int64) error {
+	if maxScanKeys > 0 && n >= maxScanKeys {
+		return ErrScanLimitExceeded
+	}
+	return nil
+}
+
+// readRepairThreshold is the drift of the stored Len that HLen repairs, read repair is disabled if it is negative
+var readRepairThreshold int64 = -1
+
+// SetReadRepair makes HLen count the fields of the hash and rewrite the meta when the stored Len differs from
+// the count by more than threshold, a negative threshold disables it. HLen becomes a scan and may write the
+// transaction, so it is meant for recovering from drifted metas rather than for every deployment
+func SetReadRepair(threshold int64) {
+	readRepairThreshold = threshold
+}
+
+// HashFlag is the optional features enabled for a hash
+type HashFlag int64
+
+const (
+	// HashFlagInsertionOrder indexes the fields by the order of insertion
+	HashFlagInsertionOrder HashFlag = 1 << iota
+	// HashFlagCompression compresses the large values of the fields
+	HashFlagCompression
+	// HashFlagVersioning counts the writes of every field
+	HashFlagVersioning
+	// HashFlagSized marks the hashes whose Bytes has been kept since their creation
+	HashFlagSized
+	// HashFlagFrozenTime keeps UpdatedAt as it is on writes
+	HashFlagFrozenTime
+	// HashFlagFieldTime records the time of the last write of every field
+	HashFlagFieldTime
+	// HashFlagBloom keeps a bloom filter of the fields in the meta
+	HashFlagBloom
+	// HashFlagUniqueValues forbids two fields to hold the same value
+	HashFlagUniqueValues
 )
 
 // HashMeta is the meta data of the hashtable
 type HashMeta struct {
 	Object
-	Len int64
+	Len   int64
+	Flags HashFlag `json:",omitempty"`
+	// Seq is the insertion sequence of the next new field
+	Seq int64 `json:",omitempty"`
+	// Bytes is the total size of the fields and their values, it is only exact with HashFlagSized
+	Bytes int64 `json:",omitempty"`
+	// Inline holds the data keys of a hash in the listpack encoding
+	Inline []inlineEntry `json:",omitempty"`
+	// Bloom is the bloom filter of the fields with HashFlagBloom
+	Bloom []byte `json:",omitempty"`
+	// Labels are the labels set by SetLabel, a meta without it has no labels
+	Labels map[string]string `json:",omitempty"`
+}
+
+// HField is a field and its value of the hashtable
+type HField struct {
+	Field []byte
+	Value []byte
 }
 
 // Hash implements the hashtable
@@ -16,24 +182,31 @@ type Hash struct {
 	meta HashMeta
 	key  []byte
 	txn  *Transaction
+
+	// rawMeta is the last known encoded meta in the store, used to skip rewriting an unchanged meta,
+	// it is nil if the hash does not exist in the store
+	rawMeta []byte
+
+	// inline serves the data keys of a hash in the listpack encoding, it is nil for a plain hash table
+	inline *inlineStore
+
+	// deferMeta holds the writes of the meta back until flushMeta, metaDirty is set if a write is pending
+	deferMeta bool
+	metaDirty bool
 }
 
 // GetHash returns a hash object, create new one if nonexists
 func GetHash(txn *Transaction, key []byte) (*Hash, error) {
+	if err := txn.db.checkPrefix(); err != nil {
+		return nil, err
+	}
 	hash := &Hash{txn: txn, key: key}
 
 	mkey := MetaKey(txn.db, key)
 	meta, err := txn.t.Get(mkey)
 	if err != nil {
 		if IsErrNotFound(err) {
-			now := Now()
-			hash.meta.CreatedAt = now
-			hash.meta.UpdatedAt = now
-			hash.meta.ExpireAt = 0
-			hash.meta.ID = UUID()
-			hash.meta.Type = ObjectHash
-			hash.meta.Encoding = ObjectEncodingHT
-			hash.meta.Len = 0
+			hash.reset()
 			return hash, nil
 		}
 		return nil, err
@@ -44,264 +217,2958 @@ func GetHash(txn *Transaction, key []byte) (*Hash, error) {
 	if hash.meta.Type != ObjectHash {
 		return nil, ErrTypeMismatch
 	}
+	hash.rawMeta = meta
+	if hash.meta.Encoding == ObjectEncodingListpack {
+		hash.inline = newInlineStore(DataKey(txn.db, hash.meta.ID), hash.meta.Inline)
+	}
 	return hash, nil
 }
+
+// reset makes the hash a new empty one with a fresh ID, as it is when the key is missing
+func (hash *Hash) reset() {
+	now := Now()
+	hash.meta = HashMeta{}
+	hash.meta.CreatedAt = now
+	hash.meta.UpdatedAt = now
+	hash.meta.ID = UUID()
+	hash.meta.Type = ObjectHash
+	hash.meta.Encoding = ObjectEncodingHT
+	hash.meta.Flags = HashFlagSized
+	hash.inline = nil
+	if inlineMaxFields > 0 && inlineMaxBytes > 0 {
+		hash.meta.Encoding = ObjectEncodingListpack
+		hash.inline = newInlineStore(DataKey(hash.txn.db, hash.meta.ID), nil)
+	}
+}
+
+// Validate checks the meta of the hash against the layout of its data, hashes are only stored as
+// plain hash tables or inline in the meta so any other encoding means the meta is corrupted
+func (hash *Hash) Validate() error {
+	if hash.meta.Encoding != ObjectEncodingHT && hash.meta.Encoding != ObjectEncodingListpack {
+		return ErrEncodingMismatch
+	}
+	return nil
+}
+
+// IsValidField returns false if field contains the Separator, the writes of hashes refuse such fields while
+// SetStrictFields is on
+func IsValidField(field []byte) bool {
+	return !bytes.Contains(field, []byte(Separator))
+}
+
+// hashItemKey builds the key of field in a fresh buffer, so keys built from the same
+// data key never share the spare capacity of it
 func hashItemKey(key []byte, field []byte) []byte {
-	key = append(key, ':')
-	return append(key, field...)
+	ikey := make([]byte, 0, len(key)+len(Separator)+len(field))
+	ikey = append(ikey, key...)
+	ikey = append(ikey, Separator...)
+	return append(ikey, field...)
 }
 
-// HDel removes the specified fields from the hash stored at key
-func (hash *Hash) HDel(fields [][]byte) (int64, error) {
-	var keys [][]byte
-	var num int64
-	dkey := DataKey(hash.txn.db, hash.meta.ID)
-	for _, field := range fields {
-		keys = append(keys, hashItemKey(dkey, field))
+// DecodeHashItemKey returns the field of ikey, the item key of a field in the hash whose data key is dkey.
+// It returns ErrCorruptField if ikey is not laid out as an item key of the hash
+func DecodeHashItemKey(dkey, ikey []byte) ([]byte, error) {
+	if !bytes.HasPrefix(ikey, dkey) || !bytes.HasPrefix(ikey[len(dkey):], []byte(Separator)) {
+		return nil, ErrCorruptField
 	}
-	values, err := BatchGetValues(hash.txn, keys)
-	if err != nil {
-		return 0, err
+	return ikey[len(dkey)+len(Separator):], nil
+}
+
+// Sub keys index the fields of a hash for the optional features, they are laid out as {DataKey}#{Tag}:{Sub}.
+// They share the data key prefix so they are collected along with the fields, but the '#' tag keeps them
+// apart from the field keys
+const (
+	hashSubOrder      = 'O' // insertion sequence -> field
+	hashSubOrderField = 'o' // field -> insertion sequence
+	hashSubVersion    = 'v' // field -> version
+	hashSubTime       = 't' // field -> time of the last write
+	hashSubValue      = 'u' // value -> field, with unique values
+)
+
+func hashSubKey(dkey []byte, tag byte, sub []byte) []byte {
+	var key []byte
+	key = append(key, dkey...)
+	key = append(key, '#', tag)
+	key = append(key, Separator...)
+	return append(key, sub...)
+}
+
+// decodeHashSubKey returns the tag and the sub of key if it is a sub key of the hash whose data key is dkey
+func decodeHashSubKey(dkey, key []byte) (byte, []byte, bool) {
+	if !bytes.HasPrefix(key, dkey) {
+		return 0, nil, false
 	}
-	for i, val := range values {
-		if val == nil {
-			continue
+	rest := key[len(dkey):]
+	if len(rest) < 2 || rest[0] != '#' || !bytes.HasPrefix(rest[2:], []byte(Separator)) {
+		return 0, nil, false
+	}
+	return rest[1], rest[2+len(Separator):], true
+}
+
+// fieldAdded maintains the sub keys of the hash for a new field
+func (hash *Hash) fieldAdded(field []byte) error {
+	if hash.meta.Flags&HashFlagInsertionOrder != 0 {
+		dkey := DataKey(hash.txn.db, hash.meta.ID)
+		seq := make([]byte, 8)
+		binary.BigEndian.PutUint64(seq, uint64(hash.meta.Seq))
+		hash.meta.Seq++
+		if err := hash.set(hashSubKey(dkey, hashSubOrder, seq), field); err != nil {
+			return err
 		}
-		if err := hash.txn.t.Delete(keys[i]); err != nil {
-			return 0, err
+		if err := hash.set(hashSubKey(dkey, hashSubOrderField, field), seq); err != nil {
+			return err
 		}
-		num++
 	}
-	if num == 0 {
-		return 0, nil
+	return nil
+}
+
+// fieldRemoved maintains the sub keys of the hash for a removed field
+func (hash *Hash) fieldRemoved(field []byte) error {
+	if hash.meta.Flags&HashFlagInsertionOrder != 0 {
+		dkey := DataKey(hash.txn.db, hash.meta.ID)
+		okey := hashSubKey(dkey, hashSubOrderField, field)
+		seq, err := hash.r().Get(okey)
+		if err != nil && !IsErrNotFound(err) {
+			return err
+		}
+		if err == nil {
+			if err := hash.delete(hashSubKey(dkey, hashSubOrder, seq)); err != nil {
+				return err
+			}
+			if err := hash.delete(okey); err != nil {
+				return err
+			}
+		}
 	}
-	hash.meta.Len -= num
-	if hash.meta.Len == 0 {
-		return num, hash.Destory()
+	if hash.meta.Flags&HashFlagVersioning != 0 {
+		dkey := DataKey(hash.txn.db, hash.meta.ID)
+		if err := hash.delete(hashSubKey(dkey, hashSubVersion, field)); err != nil {
+			return err
+		}
 	}
-	if err := hash.updateMeta(); err != nil {
-		return 0, err
+	if hash.meta.Flags&HashFlagFieldTime != 0 {
+		dkey := DataKey(hash.txn.db, hash.meta.ID)
+		if err := hash.delete(hashSubKey(dkey, hashSubTime, field)); err != nil {
+			return err
+		}
 	}
-	return num, nil
+	return nil
 }
 
-// HSet sets field in the hash stored at key to value
-func (hash *Hash) HSet(field []byte, value []byte) (int, error) {
-	dkey := DataKey(hash.txn.db, hash.meta.ID)
-	ikey := hashItemKey(dkey, field)
-	exist := true
-
-	_, err := hash.txn.t.Get(ikey)
-	if err != nil {
-		if !IsErrNotFound(err) {
-			return 0, err
+// fieldWritten maintains the sub keys of the hash for a written value
+func (hash *Hash) fieldWritten(field []byte) error {
+	hash.bloomAdd(field)
+	if hash.meta.Flags&HashFlagVersioning != 0 {
+		ver, err := hash.HVersion(field)
+		if err != nil {
+			return err
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(ver+1))
+		dkey := DataKey(hash.txn.db, hash.meta.ID)
+		if err := hash.set(hashSubKey(dkey, hashSubVersion, field), b); err != nil {
+			return err
 		}
-		exist = false
 	}
-
-	if err := hash.txn.t.Set(ikey, value); err != nil {
-		return 0, err
+	if hash.meta.Flags&HashFlagFieldTime != 0 {
+		dkey := DataKey(hash.txn.db, hash.meta.ID)
+		if err := hash.set(hashSubKey(dkey, hashSubTime, field), EncodeInt64(Now())); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	if exist {
-		return 0, nil
+// EnableVersioning counts the writes of every field of the hash from now on, so the version returned
+// by HVersion changes whenever the value of a field is written. The existing fields start at version 0,
+// and a removed field starts over when it is set again. Every write costs one more read and write.
+// It fails with ErrKeyNotFound if the hash does not exist
+func (hash *Hash) EnableVersioning() error {
+	if hash.rawMeta == nil && !hash.metaDirty {
+		return ErrKeyNotFound
 	}
-	hash.meta.Len++
-	if err := hash.updateMeta(); err != nil {
-		return 0, err
+	if hash.meta.Flags&HashFlagVersioning != 0 {
+		return nil
 	}
-	return 1, nil
+	hash.meta.Flags |= HashFlagVersioning
+	return hash.updateMeta()
 }
 
-// HSetNX sets field in the hash stored at key to value, only if field does not yet exist
-func (hash *Hash) HSetNX(field []byte, value []byte) (int, error) {
+// HVersion returns the number of writes to field since versioning was enabled, it requires EnableVersioning
+func (hash *Hash) HVersion(field []byte) (int64, error) {
+	if hash.meta.Flags&HashFlagVersioning == 0 {
+		return 0, ErrVersioningDisabled
+	}
 	dkey := DataKey(hash.txn.db, hash.meta.ID)
-	ikey := hashItemKey(dkey, field)
-
-	_, err := hash.txn.t.Get(ikey)
+	b, err := hash.r().Get(hashSubKey(dkey, hashSubVersion, field))
 	if err != nil {
-		if !IsErrNotFound(err) {
-			return 0, err
+		if IsErrNotFound(err) {
+			return 0, nil
 		}
-		return 0, nil
-	}
-	if err := hash.txn.t.Set(ikey, value); err != nil {
 		return 0, err
 	}
-
-	hash.meta.Len++
-	if err := hash.updateMeta(); err != nil {
-		return 0, err
+	if len(b) != 8 {
+		return 0, ErrInvalidLength
 	}
-	return 1, nil
+	return int64(binary.BigEndian.Uint64(b)), nil
 }
 
-// HGet returns the value associated with field in the hash stored at key
-func (hash *Hash) HGet(field []byte) ([]byte, error) {
-	dkey := DataKey(hash.txn.db, hash.meta.ID)
-	ikey := hashItemKey(dkey, field)
-	val, err := hash.txn.t.Get(ikey)
+// EnableFieldTimestamps records the time of the last write of every field from now on, the existing fields
+// are taken as written now as the times of their writes are unknown. It fails with ErrKeyNotFound if the hash
+// does not exist
+func (hash *Hash) EnableFieldTimestamps() error {
+	if hash.rawMeta == nil && !hash.metaDirty {
+		return ErrKeyNotFound
+	}
+	if hash.meta.Flags&HashFlagFieldTime != 0 {
+		return nil
+	}
+	fields, _, err := hash.HGetAll()
 	if err != nil {
-		if IsErrNotFound(err) {
-			return nil, nil
+		return err
+	}
+	hash.meta.Flags |= HashFlagFieldTime
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	now := EncodeInt64(Now())
+	for _, field := range fields {
+		if err := hash.set(hashSubKey(dkey, hashSubTime, field), now); err != nil {
+			return err
 		}
-		return nil, err
 	}
-	return val, nil
+	return hash.updateMeta()
 }
 
-// HGetAll returns all fields and values of the hash stored at key
-func (hash *Hash) HGetAll() ([][]byte, [][]byte, error) {
+// HScanModifiedSince returns the fields written at or after ts, in nanoseconds like Now, and their values in
+// key order. At most limit fields are returned unless limit is not positive. It needs EnableFieldTimestamps,
+// otherwise ErrFieldTimesDisabled is returned
+func (hash *Hash) HScanModifiedSince(ts int64, limit int64) ([][]byte, [][]byte, error) {
+	if hash.meta.Flags&HashFlagFieldTime == 0 {
+		return nil, nil, ErrFieldTimesDisabled
+	}
 	dkey := DataKey(hash.txn.db, hash.meta.ID)
-	prefix := append(dkey, ':')
-	iter, err := hash.txn.t.Seek(prefix)
+	prefix := hashSubKey(dkey, hashSubTime, nil)
+	it, err := seekHashIter(hash.r(), prefix, prefix, hash.meta.Flags)
 	if err != nil {
 		return nil, nil, err
 	}
+	defer it.close()
+
 	var fields [][]byte
-	var vals [][]byte
-	count := hash.meta.Len
-	for iter.Valid() && iter.Key().HasPrefix(prefix) && count != 0 {
-		fields = append(fields, []byte(iter.Key()[len(prefix):]))
-		vals = append(vals, iter.Value())
-		if err := iter.Next(); err != nil {
-			return nil, nil, err
+	if err := it.walk(func() (bool, error) {
+		if len(it.raw()) != 8 {
+			return false, ErrInvalidLength
+		}
+		if DecodeInt64(it.raw()) >= ts {
+			fields = append(fields, it.field())
 		}
-		count--
+		return limit <= 0 || int64(len(fields)) < limit, nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	if len(fields) == 0 {
+		return nil, nil, nil
+	}
+	vals, err := hash.HMGet(fields)
+	if err != nil {
+		return nil, nil, err
 	}
 	return fields, vals, nil
 }
 
-func (hash *Hash) updateMeta() error {
-	meta, err := json.Marshal(hash.meta)
+// EnableInsertionOrder indexes the fields of the hash by the order of insertion so they can be
+// retrieved by HGetAllInsertionOrder, the existing fields are indexed in key order. The index
+// costs two more writes for every new field. It fails with ErrKeyNotFound if the hash does not exist
+func (hash *Hash) EnableInsertionOrder() error {
+	if hash.rawMeta == nil && !hash.metaDirty {
+		return ErrKeyNotFound
+	}
+	if hash.meta.Flags&HashFlagInsertionOrder != 0 {
+		return nil
+	}
+	fields, _, err := hash.HGetAll()
 	if err != nil {
 		return err
 	}
-	return hash.txn.t.Set(MetaKey(hash.txn.db, hash.key), meta)
+	hash.meta.Flags |= HashFlagInsertionOrder
+	for _, field := range fields {
+		if err := hash.fieldAdded(field); err != nil {
+			return err
+		}
+	}
+	return hash.updateMeta()
 }
 
-// Destory the hash store
-func (hash *Hash) Destory() error {
-	return hash.txn.Destory(&hash.meta.Object, hash.key)
-}
+// The values of a hash with HashFlagCompression start with a header byte telling how the rest is encoded
+const (
+	hashValueRaw    byte = 0
+	hashValueSnappy byte = 1
 
-// HExists returns if field is an existing field in the hash stored at key
-func (hash *Hash) HExists(field []byte) (bool, error) {
-	dkey := DataKey(hash.txn.db, hash.meta.ID)
-	ikey := hashItemKey(dkey, field)
-	if _, err := hash.txn.t.Get(ikey); err != nil {
-		if IsErrNotFound(err) {
-			return false, nil
+	// hashCompressMin is the least size of a value worth compressing
+	hashCompressMin = 256
+)
+
+// encodeValue encodes a field value for the store, the values of a compressed hash which are large enough
+// are compressed with snappy when that makes them shorter
+func (hash *Hash) encodeValue(value []byte) []byte {
+	if hash.meta.Flags&HashFlagCompression == 0 {
+		return value
+	}
+	if len(value) >= hashCompressMin {
+		buf := make([]byte, 1+snappy.MaxEncodedLen(len(value)))
+		enc := snappy.Encode(buf[1:], value)
+		if len(enc) < len(value) {
+			buf[0] = hashValueSnappy
+			return buf[:1+len(enc)]
 		}
-		return false, err
 	}
-	return true, nil
+	enc := make([]byte, 0, 1+len(value))
+	enc = append(enc, hashValueRaw)
+	return append(enc, value...)
 }
 
-// HIncrBy increments the number stored at field in the hash stored at key by increment
-func (hash *Hash) HIncrBy(field []byte, v int64) (int64, error) {
-	var n int64
-	var exist bool
-
-	dkey := DataKey(hash.txn.db, hash.meta.ID)
-	ikey := hashItemKey(dkey, field)
-	val, err := hash.txn.t.Get(ikey)
-	if err != nil && !IsErrNotFound(err) {
-		return 0, err
+// decodeHashValue decodes a field value read from the store for a hash with flags, nil stays nil
+func decodeHashValue(flags HashFlag, val []byte) ([]byte, error) {
+	if flags&HashFlagCompression == 0 || val == nil {
+		return val, nil
+	}
+	if len(val) == 0 {
+		return nil, ErrCorruptedValue
 	}
-	if err == nil {
-		exist = true
-		n, err = strconv.ParseInt(string(val), 10, 64)
+	switch val[0] {
+	case hashValueRaw:
+		return val[1:], nil
+	case hashValueSnappy:
+		dec, err := snappy.Decode(nil, val[1:])
 		if err != nil {
-			return 0, err
+			return nil, ErrCorruptedValue
 		}
+		return dec, nil
 	}
-	n += v
-
-	val = []byte(strconv.FormatInt(n, 10))
-	if err := hash.txn.t.Set(ikey, val); err != nil {
-		return 0, err
-	}
+	return nil, ErrCorruptedValue
+}
 
-	if !exist {
-		hash.meta.Len++
-		if err := hash.updateMeta(); err != nil {
-			return 0, err
+// decodeHashValues decodes the field values read from the store for a hash with flags in place
+func decodeHashValues(flags HashFlag, vals [][]byte) ([][]byte, error) {
+	for i := range vals {
+		val, err := decodeHashValue(flags, vals[i])
+		if err != nil {
+			return nil, err
 		}
+		vals[i] = val
 	}
-	return n, nil
+	return vals, nil
 }
 
-// HIncrByFloat increment the specified field of a hash stored at key,
-// and representing a floating point number, by the specified increment
-func (hash *Hash) HIncrByFloat(field []byte, v float64) (float64, error) {
-	var n float64
-	var exist bool
-
-	dkey := DataKey(hash.txn.db, hash.meta.ID)
-	ikey := hashItemKey(dkey, field)
-	val, err := hash.txn.t.Get(ikey)
-	if err != nil && !IsErrNotFound(err) {
-		return 0, err
+// hashValueLen returns the size of a field value read from the store for a hash with flags without
+// decompressing it
+func hashValueLen(flags HashFlag, val []byte) (int64, error) {
+	if flags&HashFlagCompression == 0 || val == nil {
+		return int64(len(val)), nil
 	}
-	if err == nil {
-		exist = true
-		n, err = strconv.ParseFloat(string(val), 64)
+	if len(val) != 0 && val[0] == hashValueSnappy {
+		n, err := snappy.DecodedLen(val[1:])
 		if err != nil {
-			return 0, err
+			return 0, ErrCorruptedValue
 		}
+		return int64(n), nil
 	}
-	n += v
+	val, err := decodeHashValue(flags, val)
+	return int64(len(val)), err
+}
 
-	val = []byte(strconv.FormatFloat(n, 'f', -1, 64))
-	if err := hash.txn.t.Set(ikey, val); err != nil {
-		return 0, err
+// resized accounts the change of the value of field from old to val in Bytes, a nil value means the
+// field is missing
+func (hash *Hash) resized(field, old, val []byte) {
+	if old != nil {
+		hash.meta.Bytes -= int64(len(field) + len(old))
 	}
-
-	if !exist {
-		hash.meta.Len++
-		if err := hash.updateMeta(); err != nil {
-			return 0, err
-		}
+	if val != nil {
+		hash.meta.Bytes += int64(len(field) + len(val))
 	}
-	return n, nil
 }
 
-// HLen returns the number of fields contained in the hash stored at key
-func (hash *Hash) HLen() int64 {
-	return hash.meta.Len
+// setValue writes the value of a field
+func (hash *Hash) setValue(ikey []byte, value []byte) error {
+	return hash.set(ikey, hash.encodeValue(value))
 }
 
-// HMGet returns the values associated with the specified fields in the hash stored at key
-func (hash *Hash) HMGet(fields [][]byte) ([][]byte, error) {
-	ikeys := make([][]byte, len(fields))
-	dkey := DataKey(hash.txn.db, hash.meta.ID)
-	for i := range fields {
-		ikeys[i] = hashItemKey(dkey, fields[i])
+// EnableCompression compresses the large values of the hash from now on, the existing values are
+// rewritten in the encoding of a compressed hash. It fails with ErrKeyNotFound if the hash does not exist
+func (hash *Hash) EnableCompression() error {
+	if hash.rawMeta == nil && !hash.metaDirty {
+		return ErrKeyNotFound
 	}
-
-	return BatchGetValues(hash.txn, ikeys)
-}
-
-// HMSet sets the specified fields to their respective values in the hash stored at key
-func (hash *Hash) HMSet(fields [][]byte, values [][]byte) error {
-	added := int64(0)
-	oldValues, err := hash.HMGet(fields)
+	if hash.meta.Flags&HashFlagCompression != 0 {
+		return nil
+	}
+	fields, vals, err := hash.HGetAll()
 	if err != nil {
 		return err
 	}
-
+	hash.meta.Flags |= HashFlagCompression
 	dkey := DataKey(hash.txn.db, hash.meta.ID)
 	for i := range fields {
-		ikey := hashItemKey(dkey, fields[i])
-		if err := hash.txn.t.Set(ikey, values[i]); err != nil {
+		if err := hash.setValue(hashItemKey(dkey, fields[i]), vals[i]); err != nil {
 			return err
 		}
-		if oldValues[i] == nil {
-			added++
-		}
 	}
+	return hash.updateMeta()
+}
+
+// HGetAllInsertionOrder returns all fields and values of the hash stored at key in the order of insertion,
+// it requires EnableInsertionOrder
+func (hash *Hash) HGetAllInsertionOrder() ([][]byte, [][]byte, error) {
+	if hash.meta.Flags&HashFlagInsertionOrder == 0 {
+		return nil, nil, ErrInsertionOrderDisabled
+	}
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	_, fields, err := hashGetAll(context.Background(), hash.r(), hashSubKey(dkey, hashSubOrder, nil), hash.meta.Len)
+	if err != nil {
+		return nil, nil, err
+	}
+	vals, err := hash.HMGet(fields)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fields, vals, nil
+}
+
+// HDel removes the specified fields from the hash stored at key
+func (hash *Hash) HDel(fields [][]byte) (int64, error) {
+	num, _, err := hash.HDelEx(fields)
+	return num, err
+}
 
-	hash.meta.Len += added
+// HDelEx removes the specified fields from the hash stored at key like HDel, it also reports whether
+// the hash was destroyed as its last field was removed
+func (hash *Hash) HDelEx(fields [][]byte) (int64, bool, error) {
+	if len(fields) == 0 {
+		return 0, false, nil
+	}
+	// a repeated field is removed and counted once
+	fields, _ = dedupeFields(fields, fields)
+	var keys [][]byte
+	var num int64
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	for _, field := range fields {
+		keys = append(keys, hashItemKey(dkey, field))
+	}
+	values, err := hash.batchGet(keys)
+	if err != nil {
+		return 0, false, err
+	}
+	for i, val := range values {
+		if val == nil {
+			continue
+		}
+		size, err := hashValueLen(hash.meta.Flags, val)
+		if err != nil {
+			return 0, false, err
+		}
+		if err := hash.delete(keys[i]); err != nil {
+			return 0, false, err
+		}
+		if err := hash.valueRemoved(fields[i], val); err != nil {
+			return 0, false, err
+		}
+		if err := hash.fieldRemoved(fields[i]); err != nil {
+			return 0, false, err
+		}
+		hash.meta.Bytes -= int64(len(fields[i])) + size
+		num++
+	}
+	if num == 0 {
+		return 0, false, nil
+	}
+	hash.meta.Len -= num
+	if hash.meta.Len <= 0 {
+		// the stored Len may have drifted, the hash is destroyed only if no field is left
+		n, err := hash.HLenVerified()
+		if err != nil {
+			return 0, false, err
+		}
+		if n == 0 {
+			return num, true, hash.Destory()
+		}
+		hash.meta.Len = n
+	}
+	hash.touch()
+	if err := hash.downgrade(); err != nil {
+		return 0, false, err
+	}
+	if err := hash.updateMeta(); err != nil {
+		return 0, false, err
+	}
+	return num, false, nil
+}
+
+// HDelIf removes field from the hash stored at key only if its value equals expected, it returns whether
+// the field was removed
+func (hash *Hash) HDelIf(field, expected []byte) (bool, error) {
+	val, err := hash.HGet(field)
+	if err != nil || val == nil || !bytes.Equal(val, expected) {
+		return false, err
+	}
+	if _, err := hash.HDel([][]byte{field}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// HDelMatch removes the fields matching the glob-style pattern from the hash stored at key,
+// it returns the removed fields and their number. If dryRun is set, the hash is left unchanged
+// and the fields which would be removed are returned. A pattern matching every field, like "*",
+// destroys the hash without scanning it, so only the number of fields is returned then
+func (hash *Hash) HDelMatch(match string, dryRun bool) ([][]byte, int64, error) {
+	if !dryRun && match != "" && strings.Trim(match, "*") == "" {
+		if hash.rawMeta == nil && !hash.metaDirty {
+			return nil, 0, nil
+		}
+		n := hash.meta.Len
+		return nil, n, hash.Destory()
+	}
+	pattern := []byte(match)
+	mprefix := GlobMatchPrefix(pattern)
+	it, err := hash.iterFrom(mprefix)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer it.close()
+
+	var fields [][]byte
+	var keys [][]byte
+	var vals [][]byte
+	var size, scanned int64
+	err = it.walk(func() (bool, error) {
+		field := it.field()
+		if !bytes.HasPrefix(field, mprefix) {
+			return false, nil
+		}
+		scanned++
+		if GlobMatch(pattern, field, true) {
+			n, err := hashValueLen(hash.meta.Flags, it.raw())
+			if err != nil {
+				return false, err
+			}
+			fields = append(fields, field)
+			keys = append(keys, it.key())
+			vals = append(vals, it.raw())
+			size += int64(len(field)) + n
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	num := int64(len(fields))
+	if dryRun || num == 0 {
+		return fields, num, nil
+	}
+	// when the scan covered the whole hash and every field matched, destroying the hash drops
+	// the fields and the sub keys at once
+	if len(mprefix) == 0 && num == scanned {
+		return fields, num, hash.Destory()
+	}
+	for i, key := range keys {
+		if err := hash.delete(key); err != nil {
+			return nil, 0, err
+		}
+		if err := hash.valueRemoved(fields[i], vals[i]); err != nil {
+			return nil, 0, err
+		}
+		if err := hash.fieldRemoved(fields[i]); err != nil {
+			return nil, 0, err
+		}
+	}
+	hash.meta.Len -= num
+	hash.meta.Bytes -= size
+	if hash.meta.Len <= 0 {
+		// the stored Len may have drifted, the hash is destroyed only if no field is left
+		n, err := hash.HLenVerified()
+		if err != nil {
+			return nil, 0, err
+		}
+		if n == 0 {
+			return fields, num, hash.Destory()
+		}
+		hash.meta.Len = n
+	}
+	hash.touch()
+	if err := hash.updateMeta(); err != nil {
+		return nil, 0, err
+	}
+	return fields, num, nil
+}
+
+// HMGetMatch returns the fields matching any of the glob-style patterns and their values in key order,
+// at most limit fields are returned unless limit is not positive. The scan covers only the range between
+// the smallest and the largest literal prefixes of the patterns
+func (hash *Hash) HMGetMatch(patterns []string, limit int64) ([][]byte, [][]byte, error) {
+	if len(patterns) == 0 {
+		return nil, nil, nil
+	}
+	pats := make([][]byte, len(patterns))
+	prefixes := make([][]byte, len(patterns))
+	var start []byte
+	for i, p := range patterns {
+		pats[i] = []byte(p)
+		prefixes[i] = GlobMatchPrefix(pats[i])
+		if i == 0 || bytes.Compare(prefixes[i], start) < 0 {
+			start = prefixes[i]
+		}
+	}
+	// past reports if field is beyond all the fields sharing the prefixes of the patterns
+	past := func(field []byte) bool {
+		for _, prefix := range prefixes {
+			if bytes.Compare(field, prefix) <= 0 || bytes.HasPrefix(field, prefix) {
+				return false
+			}
+		}
+		return true
+	}
+
+	it, err := hash.iterFrom(start)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.close()
+
+	var fields [][]byte
+	var vals [][]byte
+	if err := it.walk(func() (bool, error) {
+		field := it.field()
+		if past(field) {
+			return false, nil
+		}
+		for _, p := range pats {
+			if GlobMatch(p, field, true) {
+				val, err := it.value()
+				if err != nil {
+					return false, err
+				}
+				fields = append(fields, field)
+				vals = append(vals, val)
+				break
+			}
+		}
+		return limit <= 0 || int64(len(fields)) < limit, nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return fields, vals, nil
+}
+
+// HSet sets field in the hash stored at key to value
+func (hash *Hash) HSet(field []byte, value []byte) (int, error) {
+	if err := checkFields(field); err != nil {
+		return 0, err
+	}
+	if err := checkValueSize(value); err != nil {
+		return 0, err
+	}
+	old, err := hash.HGet(field)
+	if err != nil {
+		return 0, err
+	}
+	return hash.hset(field, value, old)
+}
+
+// SetMode is the condition on the existence of a field for HSetCond to write it
+type SetMode int
+
+const (
+	// SetModeAlways writes the field whether it exists or not, as HSet
+	SetModeAlways SetMode = iota
+	// SetModeNX only writes the field if it does not exist, as HSETNX
+	SetModeNX
+	// SetModeXX only writes the field if it exists
+	SetModeXX
+)
+
+// HSetCond sets field in the hash stored at key to value if the existence of field meets mode, it returns
+// whether the field was written. Rewriting a field with its current value counts as written
+func (hash *Hash) HSetCond(field, value []byte, mode SetMode) (bool, error) {
+	if err := checkFields(field); err != nil {
+		return false, err
+	}
+	if err := checkValueSize(value); err != nil {
+		return false, err
+	}
+	old, err := hash.HGet(field)
+	if err != nil {
+		return false, err
+	}
+	if (mode == SetModeNX && old != nil) || (mode == SetModeXX && old == nil) {
+		return false, nil
+	}
+	if _, err := hash.hset(field, value, old); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hset sets field from old to value, a nil old value means the field is missing. It returns 1 if the field
+// is new, otherwise 0
+func (hash *Hash) hset(field, value, old []byte) (int, error) {
+	if old == nil {
+		if err := hash.checkMaxFields(1); err != nil {
+			return 0, err
+		}
+	}
+	if err := hash.checkUniqueValues([][]byte{field}, [][]byte{value}); err != nil {
+		return 0, err
+	}
+	if err := hash.replaceField(field, old, value); err != nil {
+		return 0, err
+	}
+	if old != nil && bytes.Equal(old, value) {
+		// the sub keys written above live in the meta of an inline hash
+		if hash.inline != nil {
+			return 0, hash.updateMeta()
+		}
+		return 0, nil
+	}
+	hash.touch()
+	if err := hash.updateMeta(); err != nil {
+		return 0, err
+	}
+	if old != nil {
+		return 0, nil
+	}
+	return 1, nil
+}
+
+// HSwap exchanges the values of fieldA and fieldB in the hash stored at key. A missing field is
+// treated as nil, so swapping with it moves the value of the other field
+func (hash *Hash) HSwap(fieldA, fieldB []byte) error {
+	if err := checkFields(fieldA, fieldB); err != nil {
+		return err
+	}
+	if bytes.Equal(fieldA, fieldB) {
+		return nil
+	}
+	valA, err := hash.HGet(fieldA)
+	if err != nil {
+		return err
+	}
+	valB, err := hash.HGet(fieldB)
+	if err != nil {
+		return err
+	}
+	if valA == nil && valB == nil {
+		return nil
+	}
+	if err := hash.checkUniqueValues([][]byte{fieldA, fieldB}, [][]byte{valB, valA}); err != nil {
+		return err
+	}
+	if err := hash.replaceField(fieldA, valA, valB); err != nil {
+		return err
+	}
+	if err := hash.replaceField(fieldB, valB, valA); err != nil {
+		return err
+	}
+	if !bytes.Equal(valA, valB) {
+		hash.touch()
+	}
+	return hash.updateMeta()
+}
+
+// HMerge sets field in the hash stored at key to the result of merge applied to its current value, old is nil
+// if the field is missing. It returns the merged value, a nil or empty result deletes the field as the store can
+// not hold an empty value. Nothing is written if merge fails, its error is returned as a *FieldError
+func (hash *Hash) HMerge(field []byte, merge func(old []byte) ([]byte, error)) ([]byte, error) {
+	if err := checkFields(field); err != nil {
+		return nil, err
+	}
+	old, err := hash.HGet(field)
+	if err != nil {
+		return nil, err
+	}
+	val, err := merge(old)
+	if err != nil {
+		return nil, &FieldError{Field: field, Err: err}
+	}
+	if len(val) == 0 {
+		val = nil
+	}
+	if err := checkValueSize(val); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(old, val) && (old == nil) == (val == nil) {
+		return val, nil
+	}
+	if val != nil {
+		if _, err := hash.hset(field, val, old); err != nil {
+			return nil, err
+		}
+		return val, nil
+	}
+	if err := hash.replaceField(field, old, nil); err != nil {
+		return nil, err
+	}
+	if hash.meta.Len == 0 {
+		return val, hash.Destory()
+	}
+	hash.touch()
+	if err := hash.updateMeta(); err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// HAppend appends suffix to the value of field in the hash stored at key, a missing field is set to suffix.
+// It returns the length of the resulting value. An empty suffix changes nothing, it does not create a missing
+// field as the store can not hold an empty value
+func (hash *Hash) HAppend(field, suffix []byte) (int64, error) {
+	if len(suffix) == 0 {
+		val, err := hash.HGet(field)
+		return int64(len(val)), err
+	}
+	val, err := hash.HMerge(field, func(old []byte) ([]byte, error) {
+		val := make([]byte, 0, len(old)+len(suffix))
+		return append(append(val, old...), suffix...), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(val)), nil
+}
+
+// HSetRange overwrites the value of field in the hash stored at key with data from offset on, the value is
+// padded with zero bytes up to offset if it is shorter and a missing field is created. It returns the length
+// of the resulting value. Like HAppend, empty data changes nothing
+func (hash *Hash) HSetRange(field []byte, offset int64, data []byte) (int64, error) {
+	if offset < 0 {
+		return 0, ErrOutOfRange
+	}
+	if len(data) == 0 {
+		val, err := hash.HGet(field)
+		return int64(len(val)), err
+	}
+	// refuse a range beyond the limits before allocating the padding
+	limit := int64(hsetRangeMaxSize)
+	if maxValueSize > 0 && int64(maxValueSize) < limit {
+		limit = int64(maxValueSize)
+	}
+	if offset > limit-int64(len(data)) {
+		return 0, ErrValueTooLarge
+	}
+	val, err := hash.HMerge(field, func(old []byte) ([]byte, error) {
+		size := offset + int64(len(data))
+		if size < int64(len(old)) {
+			size = int64(len(old))
+		}
+		val := make([]byte, size)
+		copy(val, old)
+		copy(val[offset:], data)
+		return val, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int64(len(val)), nil
+}
+
+// replaceField changes the value of field from old to val, a nil value means the field is missing.
+// It keeps Len and the field indexes in step but leaves writing the meta to the caller
+func (hash *Hash) replaceField(field, old, val []byte) error {
+	ikey := hashItemKey(DataKey(hash.txn.db, hash.meta.ID), field)
+	if val == nil {
+		if old == nil {
+			return nil
+		}
+		if err := hash.delete(ikey); err != nil {
+			return err
+		}
+		if err := hash.valueIndexed(field, old, nil); err != nil {
+			return err
+		}
+		hash.meta.Len--
+		hash.resized(field, old, nil)
+		return hash.fieldRemoved(field)
+	}
+	if err := hash.setValue(ikey, val); err != nil {
+		return err
+	}
+	if err := hash.fieldWritten(field); err != nil {
+		return err
+	}
+	if err := hash.valueIndexed(field, old, val); err != nil {
+		return err
+	}
+	hash.resized(field, old, val)
+	if old != nil {
+		return nil
+	}
+	hash.meta.Len++
+	return hash.fieldAdded(field)
+}
+
+// hashIter walks the keys of a hash under prefix in key order, every key taken counts against the limit of
+// SetMaxScanKeys
+type hashIter struct {
+	iter   Iterator
+	prefix []byte
+	flags  HashFlag
+	// read is the number of keys taken, walk takes at most limit keys if limit is positive
+	read  int64
+	limit int64
+}
+
+// seekHashIter returns an iterator of the keys under prefix in r from start on
+func seekHashIter(r store.Retriever, start, prefix []byte, flags HashFlag) (*hashIter, error) {
+	iter, err := r.Seek(start)
+	if err != nil {
+		return nil, err
+	}
+	return &hashIter{iter: iter, prefix: prefix, flags: flags}, nil
+}
+
+// seekReverseHashIter returns an iterator of the keys under prefix in r in descending order
+func seekReverseHashIter(r store.Retriever, prefix []byte, flags HashFlag) (*hashIter, error) {
+	iter, err := r.SeekReverse(kv.Key(prefix).PrefixNext())
+	if err != nil {
+		return nil, err
+	}
+	return &hashIter{iter: iter, prefix: prefix, flags: flags}, nil
+}
+
+// iter returns an iterator of the fields of the hash
+func (hash *Hash) iter() (*hashIter, error) {
+	return hash.iterFrom(nil)
+}
+
+// iterFrom returns an iterator of the fields of the hash from field on
+func (hash *Hash) iterFrom(field []byte) (*hashIter, error) {
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	return seekHashIter(hash.r(), hashItemKey(dkey, field), hashItemKey(dkey, nil), hash.meta.Flags)
+}
+
+func (it *hashIter) valid() bool {
+	return it.iter.Valid() && it.iter.Key().HasPrefix(it.prefix)
+}
+
+func (it *hashIter) key() []byte {
+	return []byte(it.iter.Key())
+}
+
+func (it *hashIter) field() []byte {
+	return []byte(it.iter.Key()[len(it.prefix):])
+}
+
+// raw returns the value of the key as it is stored
+func (it *hashIter) raw() []byte {
+	return it.iter.Value()
+}
+
+func (it *hashIter) value() ([]byte, error) {
+	return decodeHashValue(it.flags, it.iter.Value())
+}
+
+// take counts the current key against the limit of SetMaxScanKeys
+func (it *hashIter) take() error {
+	if err := scanKey(it.read); err != nil {
+		return err
+	}
+	it.read++
+	return nil
+}
+
+func (it *hashIter) next() error {
+	return it.iter.Next()
+}
+
+// walk takes the keys from the current one on and calls fn on each until fn returns false, the limit of
+// keys is reached or the keys are exhausted, the iterator is left on the key it stopped at. It returns the
+// error of fn, of SetMaxScanKeys or of the store
+func (it *hashIter) walk(fn func() (bool, error)) error {
+	for it.valid() && (it.limit <= 0 || it.read < it.limit) {
+		if err := it.take(); err != nil {
+			return err
+		}
+		more, err := fn()
+		if err != nil || !more {
+			return err
+		}
+		if err := it.iter.Next(); err != nil {
+			return err
+		}
+	}
+	return iterErr(it.iter)
+}
+
+func (it *hashIter) close() {
+	it.iter.Close()
+}
+
+// HashIterator walks the fields of a hash in key order:
+//
+//	it := hash.Iterator()
+//	defer it.Close()
+//	for it.Next() {
+//		f, v := it.Field(), it.Value()
+//	}
+//	return it.Err()
+//
+// The store iterator is closed once the fields are exhausted or an error occurs, Close releases it early
+type HashIterator struct {
+	it      *hashIter
+	started bool
+	field   []byte
+	value   []byte
+	err     error
+}
+
+// Iterator returns an iterator of the fields of the hash stored at key
+func (hash *Hash) Iterator() *HashIterator {
+	it, err := hash.iter()
+	return &HashIterator{it: it, err: err}
+}
+
+// Next moves to the next field, it returns false when the fields are exhausted or an error occurs
+func (it *HashIterator) Next() bool {
+	if it.err != nil || it.it == nil {
+		return false
+	}
+	if it.started {
+		if it.err = it.it.next(); it.err != nil {
+			it.Close()
+			return false
+		}
+	}
+	it.started = true
+	if !it.it.valid() {
+		it.err = iterErr(it.it.iter)
+		it.Close()
+		return false
+	}
+	if it.err = it.it.take(); it.err != nil {
+		it.Close()
+		return false
+	}
+	it.field = append(it.field[:0], it.it.field()...)
+	if it.value, it.err = it.it.value(); it.err != nil {
+		it.Close()
+		return false
+	}
+	return true
+}
+
+// Field returns the current field, it is only valid until the next call of Next
+func (it *HashIterator) Field() []byte { return it.field }
+
+// Value returns the value of the current field
+func (it *HashIterator) Value() []byte { return it.value }
+
+// Err returns the error which stopped the iteration
+func (it *HashIterator) Err() error { return it.err }
+
+// Close releases the store iterator, it is safe to call more than once
+func (it *HashIterator) Close() {
+	if it.it != nil {
+		it.it.close()
+		it.it = nil
+	}
+}
+
+// HDiff compares the hashes stored at keyA and keyB by walking their fields side by side, it returns the fields
+// only in the first hash, the fields only in the second one and the fields in both having different values.
+// A missing hash has no fields
+func HDiff(txn *Transaction, keyA, keyB []byte) ([][]byte, [][]byte, [][]byte, error) {
+	hashA, err := GetHash(txn, keyA)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	hashB, err := GetHash(txn, keyB)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	a, err := hashA.iter()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer a.close()
+	b, err := hashB.iter()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer b.close()
+
+	var onlyA, onlyB, mismatch [][]byte
+	for a.valid() || b.valid() {
+		var stepA, stepB bool
+		switch {
+		case !b.valid():
+			onlyA = append(onlyA, a.field())
+			stepA = true
+		case !a.valid():
+			onlyB = append(onlyB, b.field())
+			stepB = true
+		default:
+			fa, fb := a.field(), b.field()
+			switch c := bytes.Compare(fa, fb); {
+			case c < 0:
+				onlyA = append(onlyA, fa)
+				stepA = true
+			case c > 0:
+				onlyB = append(onlyB, fb)
+				stepB = true
+			default:
+				va, err := a.value()
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				vb, err := b.value()
+				if err != nil {
+					return nil, nil, nil, err
+				}
+				if !bytes.Equal(va, vb) {
+					mismatch = append(mismatch, fa)
+				}
+				stepA, stepB = true, true
+			}
+		}
+		if stepA {
+			if err := a.take(); err != nil {
+				return nil, nil, nil, err
+			}
+			if err := a.next(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+		if stepB {
+			if err := b.take(); err != nil {
+				return nil, nil, nil, err
+			}
+			if err := b.next(); err != nil {
+				return nil, nil, nil, err
+			}
+		}
+	}
+	if err := iterErr(a.iter); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := iterErr(b.iter); err != nil {
+		return nil, nil, nil, err
+	}
+	return onlyA, onlyB, mismatch, nil
+}
+
+// HSetOpts customizes the writes of HSetWithOpts
+type HSetOpts struct {
+	// KeepTTL keeps the expiration of the hash, otherwise the write makes the hash persistent
+	KeepTTL bool
+}
+
+// HSetWithOpts sets field in the hash stored at key to value like HSet. As SET does in redis, the write
+// clears the expiration of the hash unless opts.KeepTTL is set, while HSet always keeps it
+func (hash *Hash) HSetWithOpts(field []byte, value []byte, opts HSetOpts) (int, error) {
+	if opts.KeepTTL || hash.meta.ExpireAt == 0 {
+		return hash.HSet(field, value)
+	}
+	if err := checkFields(field); err != nil {
+		return 0, err
+	}
+	if err := checkValueSize(value); err != nil {
+		return 0, err
+	}
+	old, err := hash.HGet(field)
+	if err != nil {
+		return 0, err
+	}
+	// the meta written by hset carries the cleared expiration
+	at := hash.meta.ExpireAt
+	hash.meta.ExpireAt = 0
+	n, err := hash.hset(field, value, old)
+	if err != nil {
+		hash.meta.ExpireAt = at
+		return 0, err
+	}
+	// hset leaves the meta alone when the value is unchanged
+	if old != nil && bytes.Equal(old, value) {
+		if err := hash.updateMeta(); err != nil {
+			return 0, err
+		}
+	}
+	if err := hash.delete(expireKey(MetaKey(hash.txn.db, hash.key), at)); err != nil {
+		return 0, err
+	}
+	metrics.GetMetrics().ExpireKeysTotal.WithLabelValues("removed").Inc()
+	return n, nil
+}
+
+// HMoveField moves field with its value from the hash stored at srcKey to the hash stored at dstKey in txn,
+// overwriting the field in the destination. It returns false if the field is absent in the source
+func HMoveField(txn *Transaction, srcKey, dstKey, field []byte) (bool, error) {
+	src, err := GetHash(txn, srcKey)
+	if err != nil {
+		return false, err
+	}
+	val, err := src.HGet(field)
+	if err != nil || val == nil {
+		return false, err
+	}
+	if bytes.Equal(srcKey, dstKey) {
+		return true, nil
+	}
+	dst, err := GetHash(txn, dstKey)
+	if err != nil {
+		return false, err
+	}
+	if _, err := src.HDel([][]byte{field}); err != nil {
+		return false, err
+	}
+	if _, err := dst.HSet(field, val); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Hashes loads every hash at most once in a transaction and defers writing their metas, see WithHashes
+type Hashes struct {
+	txn    *Transaction
+	hashes map[string]*Hash
+}
+
+// Get returns the hash stored at key, the hash loaded by an earlier call is returned for the same key.
+// The hashes of a Hashes must not be loaded with GetHash as they would miss the deferred metas
+func (hs *Hashes) Get(key []byte) (*Hash, error) {
+	if hash, ok := hs.hashes[string(key)]; ok {
+		return hash, nil
+	}
+	hash, err := GetHash(hs.txn, key)
+	if err != nil {
+		return nil, err
+	}
+	hash.deferMeta = true
+	hs.hashes[string(key)] = hash
+	return hash, nil
+}
+
+// WithHashes runs fn with the hashes of txn, the metas changed by fn are written once after it returns.
+// If fn or writing the metas fails the error is returned and txn must be rolled back, so the operations
+// of fn are committed either all or none
+func WithHashes(txn *Transaction, fn func(hs *Hashes) error) error {
+	hs := &Hashes{txn: txn, hashes: make(map[string]*Hash)}
+	if err := fn(hs); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(hs.hashes))
+	for key := range hs.hashes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := hs.hashes[key].flushMeta(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HSetNX sets field in the hash stored at key to value, only if field does not yet exist. It returns 1 if
+// the field was set, otherwise 0
+func (hash *Hash) HSetNX(field []byte, value []byte) (int, error) {
+	ok, err := hash.HSetCond(field, value, SetModeNX)
+	if err != nil || !ok {
+		return 0, err
+	}
+	return 1, nil
+}
+
+// HGet returns the value associated with field in the hash stored at key
+func (hash *Hash) HGet(field []byte) ([]byte, error) {
+	if hash.bloomRejects(field) {
+		return nil, nil
+	}
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	ikey := hashItemKey(dkey, field)
+	val, err := hash.r().Get(ikey)
+	if err != nil {
+		if IsErrNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return decodeHashValue(hash.meta.Flags, val)
+}
+
+// HGetRange returns the bytes of the value of field in the hash stored at key from start to end, both
+// inclusive. Negative offsets count from the end of the value, -1 being the last byte, and the range is
+// clamped to the value. It returns an empty slice if the range is empty or field is missing. The whole value
+// is still read from the store, only the range is handed to the caller
+func (hash *Hash) HGetRange(field []byte, start, end int64) ([]byte, error) {
+	val, err := hash.HGet(field)
+	if err != nil {
+		return nil, err
+	}
+	n := int64(len(val))
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if start > end {
+		return []byte{}, nil
+	}
+	return val[start : end+1], nil
+}
+
+// FieldError records an error about a field of a hash
+type FieldError struct {
+	Field []byte
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("field %q: %s", e.Field, e.Err)
+}
+
+// RestoreError records a failed write and the failure to restore the keys written before it, the transaction
+// is left in an unknown state and must be rolled back
+type RestoreError struct {
+	Err        error
+	RestoreErr error
+}
+
+func (e *RestoreError) Error() string {
+	return fmt.Sprintf("%s, restore failed: %s", e.Err, e.RestoreErr)
+}
+
+// KeyError records an error about a raw key in the store
+type KeyError struct {
+	Key []byte
+	Err error
+}
+
+func (e *KeyError) Error() string {
+	return fmt.Sprintf("key %q: %s", e.Key, e.Err)
+}
+
+// HGetTyped returns the value associated with field in the hash stored at key if it passes validate,
+// otherwise it returns a *FieldError wrapping the validation error
+func (hash *Hash) HGetTyped(field []byte, validate func([]byte) error) ([]byte, error) {
+	val, err := hash.HGet(field)
+	if err != nil || val == nil {
+		return nil, err
+	}
+	if err := validate(val); err != nil {
+		return nil, &FieldError{Field: field, Err: err}
+	}
+	return val, nil
+}
+
+// HGetAll returns all fields and values of the hash stored at key, the fields are ordered by their bytes
+// as the item keys are, so the order is reproducible for the same content
+func (hash *Hash) HGetAll() ([][]byte, [][]byte, error) {
+	return hash.HGetAllCtx(context.Background())
+}
+
+// HGetAllCtx returns all fields and values of the hash stored at key like HGetAll, the scan is abandoned
+// with the error of ctx once ctx is done
+func (hash *Hash) HGetAllCtx(ctx context.Context) ([][]byte, [][]byte, error) {
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	fields, vals, err := hashGetAll(ctx, hash.r(), hashItemKey(dkey, nil), hash.meta.Len)
+	if err != nil {
+		return nil, nil, err
+	}
+	vals, err = decodeHashValues(hash.meta.Flags, vals)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fields, vals, nil
+}
+
+// HGetAllTransform returns all fields of the hash stored at key with their values replaced by the result of fn,
+// so a value can be redacted before it is handed to the caller
+func (hash *Hash) HGetAllTransform(fn func(field, value []byte) []byte) ([][]byte, [][]byte, error) {
+	fields, vals, err := hash.HGetAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range fields {
+		vals[i] = fn(fields[i], vals[i])
+	}
+	return fields, vals, nil
+}
+
+// HGetAllExcept returns all fields and values of the hash stored at key like HGetAll except the fields in deny,
+// the values of the denied fields are skipped while scanning and never decoded or returned
+func (hash *Hash) HGetAllExcept(deny [][]byte) ([][]byte, [][]byte, error) {
+	denied := make(map[string]struct{}, len(deny))
+	for _, field := range deny {
+		denied[string(field)] = struct{}{}
+	}
+	it, err := hash.iter()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.close()
+
+	var fields [][]byte
+	var vals [][]byte
+	// the denied fields are read all the same, so they count against the limit
+	if err := it.walk(func() (bool, error) {
+		if _, ok := denied[string(it.field())]; !ok {
+			val, err := it.value()
+			if err != nil {
+				return false, err
+			}
+			fields = append(fields, it.field())
+			vals = append(vals, val)
+		}
+		return true, nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return fields, vals, nil
+}
+
+// DistinctValueCount estimates the number of distinct values of the fields of the hash stored at key with a
+// HyperLogLog, the error is usually within 1%. Only the values of the first sample fields are counted,
+// all of them if sample is not positive
+func (hash *Hash) DistinctValueCount(sample int64) (int64, error) {
+	it, err := hash.iter()
+	if err != nil {
+		return 0, err
+	}
+	defer it.close()
+
+	h := &hll{}
+	it.limit = sample
+	if err := it.walk(func() (bool, error) {
+		val, err := it.value()
+		if err != nil {
+			return false, err
+		}
+		h.add(val)
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+	if it.read == 0 {
+		return 0, nil
+	}
+	return h.count(), nil
+}
+
+// HMaxField returns the field holding the largest integer in the hash stored at key and the integer, the values
+// which are not integers are skipped and the first field in key order wins a tie. It returns ErrFieldNotFound
+// if the hash is empty or holds no integer
+func (hash *Hash) HMaxField() ([]byte, int64, error) {
+	return hash.extremeField(func(n, m int64) bool { return n > m })
+}
+
+// HMinField returns the field holding the smallest integer in the hash stored at key like HMaxField
+func (hash *Hash) HMinField() ([]byte, int64, error) {
+	return hash.extremeField(func(n, m int64) bool { return n < m })
+}
+
+// extremeField returns the first field whose integer is not beaten by another, n beats m if better(n, m)
+func (hash *Hash) extremeField(better func(n, m int64) bool) ([]byte, int64, error) {
+	it, err := hash.iter()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer it.close()
+
+	var field []byte
+	var value int64
+	if err := it.walk(func() (bool, error) {
+		val, err := it.value()
+		if err != nil {
+			return false, err
+		}
+		if n, err := strconv.ParseInt(string(val), 10, 64); err == nil && (field == nil || better(n, value)) {
+			field, value = append([]byte{}, it.field()...), n
+		}
+		return true, nil
+	}); err != nil {
+		return nil, 0, err
+	}
+	if field == nil {
+		return nil, 0, ErrFieldNotFound
+	}
+	return field, value, nil
+}
+
+// RespWriter writes the replies of RESP, it is implemented by resp.Encoder
+type RespWriter interface {
+	Array(size int) error
+	BulkString(s string) error
+}
+
+// HGetAllToResp writes all fields and values of the hash stored at key to w as the reply of HGETALL. The array
+// header is sized from Len, so the fields are read into the strings passed to w and counted before anything is
+// written, ErrLenMismatch is returned if they differ from Len and w is left untouched on any error
+func (hash *Hash) HGetAllToResp(w RespWriter) error {
+	it, err := hash.iter()
+	if err != nil {
+		return err
+	}
+	defer it.close()
+
+	items := make([]string, 0, 2*hash.meta.Len)
+	if err := it.walk(func() (bool, error) {
+		if it.read > hash.meta.Len {
+			return false, ErrLenMismatch
+		}
+		val, err := it.value()
+		if err != nil {
+			return false, err
+		}
+		items = append(items, string(it.field()), string(val))
+		return true, nil
+	}); err != nil {
+		return err
+	}
+	if it.read != hash.meta.Len {
+		return ErrLenMismatch
+	}
+
+	if err := w.Array(len(items)); err != nil {
+		return err
+	}
+	for _, item := range items {
+		if err := w.BulkString(item); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HGetAllPacked returns all fields of the hash stored at key like HGetAll with their values concatenated in
+// valueBuf, the value of fields[i] is valueBuf[offsets[i]:offsets[i+1]]. It saves allocating every value
+// of a large hash separately
+func (hash *Hash) HGetAllPacked() (fields [][]byte, valueBuf []byte, offsets []int, err error) {
+	it, err := hash.iter()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer it.close()
+
+	offsets = []int{0}
+	if err := it.walk(func() (bool, error) {
+		val, err := it.value()
+		if err != nil {
+			return false, err
+		}
+		fields = append(fields, it.field())
+		valueBuf = append(valueBuf, val...)
+		offsets = append(offsets, len(valueBuf))
+		return true, nil
+	}); err != nil {
+		return nil, nil, nil, err
+	}
+	return fields, valueBuf, offsets, nil
+}
+
+// HGetAllStrict returns all fields and values of the hash stored at key like HGetAll, but it reads every key
+// under the data key of the hash and checks it is either the item key of a field or a sub key. A key of
+// neither layout is reported as a *KeyError wrapping ErrCorruptField, HGetAll never reads such keys
+func (hash *Hash) HGetAllStrict() ([][]byte, [][]byte, error) {
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	it, err := seekHashIter(hash.r(), dkey, dkey, hash.meta.Flags)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.close()
+
+	var fields [][]byte
+	var vals [][]byte
+	if err := it.walk(func() (bool, error) {
+		key := it.key()
+		if _, _, ok := decodeHashSubKey(dkey, key); ok {
+			return true, nil
+		}
+		field, err := DecodeHashItemKey(dkey, key)
+		if err != nil {
+			return false, &KeyError{Key: append([]byte{}, key...), Err: err}
+		}
+		val, err := it.value()
+		if err != nil {
+			return false, err
+		}
+		fields = append(fields, append([]byte{}, field...))
+		vals = append(vals, val)
+		return true, nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return fields, vals, nil
+}
+
+// HGetAllReverse returns all fields and values of the hash stored at key in descending order of fields.
+// It iterates backward from the end of the fields when the store supports reverse seeks, otherwise
+// it reverses the result of HGetAll. TiKV does not implement reverse seeks, so with TiKV it is the latter
+func (hash *Hash) HGetAllReverse() ([][]byte, [][]byte, error) {
+	prefix := hashItemKey(DataKey(hash.txn.db, hash.meta.ID), nil)
+	it, err := seekReverseHashIter(hash.r(), prefix, hash.meta.Flags)
+	if err != nil {
+		if !kv.ErrNotImplemented.Equal(err) {
+			return nil, nil, err
+		}
+		fields, vals, err := hash.HGetAll()
+		if err != nil {
+			return nil, nil, err
+		}
+		for i, j := 0, len(fields)-1; i < j; i, j = i+1, j-1 {
+			fields[i], fields[j] = fields[j], fields[i]
+			vals[i], vals[j] = vals[j], vals[i]
+		}
+		return fields, vals, nil
+	}
+	defer it.close()
+
+	var fields [][]byte
+	var vals [][]byte
+	if err := it.walk(func() (bool, error) {
+		val, err := it.value()
+		if err != nil {
+			return false, err
+		}
+		fields = append(fields, it.field())
+		vals = append(vals, val)
+		return true, nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return fields, vals, nil
+}
+
+// HGetAllLazy returns all fields of the hash stored at key with a getter per field, which reads the value
+// from the transaction only when it is called. Only the keys are collected by the scan, the values the store
+// returns along with them are neither decoded nor kept, so a caller holding many large values can page
+// through them
+func (hash *Hash) HGetAllLazy() ([][]byte, []func() ([]byte, error), error) {
+	it, err := hash.iter()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.close()
+
+	var fields [][]byte
+	if err := it.walk(func() (bool, error) {
+		fields = append(fields, it.field())
+		return true, nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	getters := make([]func() ([]byte, error), len(fields))
+	for i := range fields {
+		field := fields[i]
+		getters[i] = func() ([]byte, error) {
+			return hash.HGet(field)
+		}
+	}
+	return fields, getters, nil
+}
+
+// hashJSONBinary is the JSON form of a value which is not valid UTF-8, the value is base64 encoded
+// with the standard alphabet and padding as {"base64":"..."}
+type hashJSONBinary struct {
+	Base64 []byte `json:"base64"`
+}
+
+// HGetAllJSON returns the hash stored at key as a JSON object of fields to values. A value which is valid
+// UTF-8 is a JSON string, any other value is an object holding it in base64, see ParseHashJSON. The fields
+// must be valid UTF-8, otherwise a *FieldError wrapping ErrInvalidUTF8 is returned
+func (hash *Hash) HGetAllJSON() ([]byte, error) {
+	fields, vals, err := hash.HGetAll()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i := range fields {
+		if !utf8.Valid(fields[i]) {
+			return nil, &FieldError{Field: fields[i], Err: ErrInvalidUTF8}
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, err := json.Marshal(string(fields[i]))
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+
+		var val []byte
+		if utf8.Valid(vals[i]) {
+			val, err = json.Marshal(string(vals[i]))
+		} else {
+			val, err = json.Marshal(hashJSONBinary{Base64: vals[i]})
+		}
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// HGetAllJSONPath returns all fields of the hash stored at key with the part of their values selected by path,
+// the values are parsed as JSON documents. The path starts with "$" for the document and is followed by ".key"
+// for a member of an object and "[n]" for an element of an array, e.g. "$.user.tags[0]". The extracted part is
+// returned as JSON, it is nil for a value which is not JSON or lacks the path
+func (hash *Hash) HGetAllJSONPath(path string) (fields [][]byte, extracted [][]byte, err error) {
+	steps, err := parseJSONPath(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	fields, vals, err := hash.HGetAll()
+	if err != nil {
+		return nil, nil, err
+	}
+	extracted = make([][]byte, len(vals))
+	for i := range vals {
+		extracted[i] = extractJSONPath(vals[i], steps)
+	}
+	return fields, extracted, nil
+}
+
+// jsonPathStep is a member of an object if index is negative, otherwise an element of an array
+type jsonPathStep struct {
+	key   string
+	index int
+}
+
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, ErrInvalidJSONPath
+	}
+	var steps []jsonPathStep
+	for p := path[1:]; p != ""; {
+		switch p[0] {
+		case '.':
+			end := strings.IndexAny(p[1:], ".[") + 1
+			if end == 0 {
+				end = len(p)
+			}
+			if end == 1 {
+				return nil, ErrInvalidJSONPath
+			}
+			steps = append(steps, jsonPathStep{key: p[1:end], index: -1})
+			p = p[end:]
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, ErrInvalidJSONPath
+			}
+			n, err := strconv.Atoi(p[1:end])
+			if err != nil || n < 0 {
+				return nil, ErrInvalidJSONPath
+			}
+			steps = append(steps, jsonPathStep{index: n})
+			p = p[end+1:]
+		default:
+			return nil, ErrInvalidJSONPath
+		}
+	}
+	return steps, nil
+}
+
+// extractJSONPath returns the part of doc selected by steps, or nil if doc is not JSON or lacks the part
+func extractJSONPath(doc []byte, steps []jsonPathStep) []byte {
+	cur := json.RawMessage(doc)
+	if !json.Valid(cur) {
+		return nil
+	}
+	for _, step := range steps {
+		if step.index < 0 {
+			var obj map[string]json.RawMessage
+			if err := json.Unmarshal(cur, &obj); err != nil {
+				return nil
+			}
+			next, ok := obj[step.key]
+			if !ok {
+				return nil
+			}
+			cur = next
+			continue
+		}
+		var arr []json.RawMessage
+		if err := json.Unmarshal(cur, &arr); err != nil || step.index >= len(arr) {
+			return nil
+		}
+		cur = arr[step.index]
+	}
+	return bytes.TrimSpace(cur)
+}
+
+// ParseHashJSON decodes the fields and values from the output of HGetAllJSON, the fields are sorted
+func ParseHashJSON(data []byte) ([][]byte, [][]byte, error) {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, nil, err
+	}
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([][]byte, len(keys))
+	vals := make([][]byte, len(keys))
+	for i, key := range keys {
+		fields[i] = []byte(key)
+		raw := obj[key]
+		if len(raw) > 0 && raw[0] == '"' {
+			var val string
+			if err := json.Unmarshal(raw, &val); err != nil {
+				return nil, nil, err
+			}
+			vals[i] = []byte(val)
+			continue
+		}
+		var bin hashJSONBinary
+		if err := json.Unmarshal(raw, &bin); err != nil {
+			return nil, nil, err
+		}
+		vals[i] = bin.Base64
+	}
+	return fields, vals, nil
+}
+
+// hashBlobVersion is the first byte of a frozen hash, the fields and values follow as uvarint length
+// prefixed byte strings after the uvarint number of fields
+const hashBlobVersion = 1
+
+// Freeze serializes the fields and values of the hash into a string stored at dstKey and deletes the hash,
+// dstKey may be the key of the hash itself. The options and the expiration of the hash are not kept.
+// It fails with ErrKeyNotFound if the hash does not exist
+func (hash *Hash) Freeze(dstKey []byte) error {
+	if hash.rawMeta == nil && !hash.metaDirty {
+		return ErrKeyNotFound
+	}
+	fields, vals, err := hash.HGetAll()
+	if err != nil {
+		return err
+	}
+	blob := make([]byte, 1+binary.MaxVarintLen64)
+	blob[0] = hashBlobVersion
+	blob = blob[:1+binary.PutUvarint(blob[1:], uint64(len(fields)))]
+	for i := range fields {
+		blob = appendUvarintBytes(blob, fields[i])
+		blob = appendUvarintBytes(blob, vals[i])
+	}
+
+	if err := hash.Destory(); err != nil {
+		return err
+	}
+	str, err := GetString(hash.txn, dstKey)
+	if err != nil {
+		return err
+	}
+	return str.Set(blob)
+}
+
+// Thaw restores the hash frozen into the string stored at srcKey to a hash stored at dstHashKey and deletes
+// the string, a hash existing at dstHashKey is replaced
+func Thaw(txn *Transaction, srcKey, dstHashKey []byte) error {
+	str, err := GetString(txn, srcKey)
+	if err != nil {
+		return err
+	}
+	blob, err := str.Get()
+	if err != nil {
+		return err
+	}
+	fields, vals, err := decodeHashBlob(blob)
+	if err != nil {
+		return err
+	}
+	if err := txn.Destory(&str.Meta.Object, srcKey); err != nil {
+		return err
+	}
+
+	hash, err := GetHash(txn, dstHashKey)
+	if err != nil {
+		return err
+	}
+	if hash.rawMeta != nil {
+		if err := hash.Destory(); err != nil {
+			return err
+		}
+		if hash, err = GetHash(txn, dstHashKey); err != nil {
+			return err
+		}
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	return hash.BulkLoad(fields, vals, true)
+}
+
+func appendUvarintBytes(b []byte, v []byte) []byte {
+	var n [binary.MaxVarintLen64]byte
+	b = append(b, n[:binary.PutUvarint(n[:], uint64(len(v)))]...)
+	return append(b, v...)
+}
+
+func decodeHashBlob(blob []byte) ([][]byte, [][]byte, error) {
+	if len(blob) == 0 || blob[0] != hashBlobVersion {
+		return nil, nil, ErrCorruptedValue
+	}
+	blob = blob[1:]
+	count, n := binary.Uvarint(blob)
+	if n <= 0 || count > uint64(len(blob)) {
+		return nil, nil, ErrCorruptedValue
+	}
+	blob = blob[n:]
+	next := func() ([]byte, bool) {
+		l, n := binary.Uvarint(blob)
+		if n <= 0 || l > uint64(len(blob)-n) {
+			return nil, false
+		}
+		v := blob[n : n+int(l)]
+		blob = blob[n+int(l):]
+		return v, true
+	}
+	fields := make([][]byte, count)
+	vals := make([][]byte, count)
+	for i := range fields {
+		var ok bool
+		if fields[i], ok = next(); !ok {
+			return nil, nil, ErrCorruptedValue
+		}
+		if vals[i], ok = next(); !ok {
+			return nil, nil, ErrCorruptedValue
+		}
+	}
+	if len(blob) != 0 {
+		return nil, nil, ErrCorruptedValue
+	}
+	return fields, vals, nil
+}
+
+// hashGetAll collects at most count fields and values under prefix until ctx is done
+func hashGetAll(ctx context.Context, r store.Retriever, prefix []byte, count int64) ([][]byte, [][]byte, error) {
+	if count == 0 {
+		return nil, nil, nil
+	}
+	it, err := seekHashIter(r, prefix, prefix, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer it.close()
+
+	// the results grow with the keys actually found, meta.Len only bounds the scan
+	// and must never size an allocation as it may be corrupted
+	var fields [][]byte
+	var vals [][]byte
+	it.limit = count
+	if err := it.walk(func() (bool, error) {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+		fields = append(fields, it.field())
+		vals = append(vals, it.raw())
+		return true, nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	return fields, vals, nil
+}
+
+// SnapshotReader reads hashes from the snapshot pinned by a transaction, so that the reads of several keys
+// reflect the same point in time. The uncommitted writes of the transaction are not visible to the reader
+type SnapshotReader struct {
+	db   *DB
+	snap store.Snapshot
+}
+
+// NewSnapshotReader returns a reader of the snapshot of txn
+func NewSnapshotReader(txn *Transaction) *SnapshotReader {
+	return &SnapshotReader{db: txn.db, snap: txn.t.GetSnapshot()}
+}
+
+// ReadHashAll returns all fields and values of the hash stored at key
+func (r *SnapshotReader) ReadHashAll(key []byte) ([][]byte, [][]byte, error) {
+	raw, err := r.snap.Get(MetaKey(r.db, key))
+	if err != nil {
+		if IsErrNotFound(err) {
+			return nil, nil, nil
+		}
+		return nil, nil, err
+	}
+	var meta HashMeta
+	if err := json.Unmarshal(raw, &meta); err != nil {
+		return nil, nil, err
+	}
+	if meta.Type != ObjectHash {
+		return nil, nil, ErrTypeMismatch
+	}
+	dkey := DataKey(r.db, meta.ID)
+	var retriever store.Retriever = r.snap
+	if meta.Encoding == ObjectEncodingListpack {
+		retriever = newInlineStore(dkey, meta.Inline)
+	}
+	fields, vals, err := hashGetAll(context.Background(), retriever, hashItemKey(dkey, nil), meta.Len)
+	if err != nil {
+		return nil, nil, err
+	}
+	vals, err = decodeHashValues(meta.Flags, vals)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fields, vals, nil
+}
+
+// HTrim removes the fields beyond the first max ones in key order and returns the number of fields removed,
+// the hash is destroyed if max is 0
+func (hash *Hash) HTrim(max int64) (int64, error) {
+	if max < 0 {
+		return 0, ErrOutOfRange
+	}
+	if hash.meta.Len <= max {
+		return 0, nil
+	}
+	if max == 0 {
+		removed := hash.meta.Len
+		return removed, hash.Destory()
+	}
+
+	it, err := hash.iter()
+	if err != nil {
+		return 0, err
+	}
+	defer it.close()
+
+	// the fields are collected before any is removed, so a failed scan leaves the hash unchanged
+	var kept int64
+	var keys, fields, vals [][]byte
+	err = it.walk(func() (bool, error) {
+		if kept < max {
+			kept++
+			return true, nil
+		}
+		keys = append(keys, it.key())
+		fields = append(fields, it.field())
+		vals = append(vals, it.raw())
+		return true, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	removed := int64(len(keys))
+	if removed == 0 {
+		return 0, nil
+	}
+	for i, key := range keys {
+		size, err := hashValueLen(hash.meta.Flags, vals[i])
+		if err != nil {
+			return 0, err
+		}
+		if err := hash.delete(key); err != nil {
+			return 0, err
+		}
+		if err := hash.valueRemoved(fields[i], vals[i]); err != nil {
+			return 0, err
+		}
+		if err := hash.fieldRemoved(fields[i]); err != nil {
+			return 0, err
+		}
+		hash.meta.Bytes -= int64(len(fields[i])) + size
+	}
+	hash.meta.Len -= removed
+	hash.touch()
+	if err := hash.updateMeta(); err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+// HStream emits the fields and values of the hash stored at key in key order until the end of the hash
+// or the cancellation of ctx, the consumer decides the pace of the scan. The error channel receives
+// the result once the field channel is closed. The transaction must not be used until the stream ends
+func (hash *Hash) HStream(ctx context.Context) (<-chan HField, <-chan error) {
+	fieldc := make(chan HField)
+	errc := make(chan error, 1)
+	go func() {
+		defer close(errc)
+		defer close(fieldc)
+		errc <- hash.stream(ctx, fieldc)
+	}()
+	return fieldc, errc
+}
+
+func (hash *Hash) stream(ctx context.Context, fieldc chan<- HField) error {
+	it, err := hash.iter()
+	if err != nil {
+		return err
+	}
+	defer it.close()
+
+	return it.walk(func() (bool, error) {
+		val, err := it.value()
+		if err != nil {
+			return false, err
+		}
+		select {
+		case fieldc <- HField{Field: it.field(), Value: val}:
+			return true, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	})
+}
+
+// HScanCursor is the opaque position of an HScan iteration, it only encodes the ID of the hash and the field
+// to continue from, so a cursor stays valid across transactions and restarts of the server
+type HScanCursor struct {
+	id    []byte
+	field []byte
+}
+
+// ParseHScanCursor decodes a cursor returned by HScanCursor.Bytes, "0" starts a new scan
+func ParseHScanCursor(b []byte) (*HScanCursor, error) {
+	if len(b) == 0 || bytes.Equal(b, []byte("0")) {
+		return &HScanCursor{}, nil
+	}
+	raw := make([]byte, base64.RawURLEncoding.DecodedLen(len(b)))
+	n, err := base64.RawURLEncoding.Decode(raw, b)
+	if err != nil || n == 0 {
+		return nil, ErrInvalidCursor
+	}
+	if raw[0] != hscanCursorVersion {
+		return nil, ErrStaleCursor
+	}
+	if n < 2 || int(raw[1]) > n-2 {
+		return nil, ErrInvalidCursor
+	}
+	idLen := int(raw[1])
+	return &HScanCursor{id: raw[2 : 2+idLen], field: raw[2+idLen : n]}, nil
+}
+
+// Bytes returns the encoded cursor, a nil cursor which marks the end of a scan is encoded as "0"
+func (c *HScanCursor) Bytes() []byte {
+	if c == nil {
+		return []byte("0")
+	}
+	raw := make([]byte, 0, len(c.id)+len(c.field)+2)
+	raw = append(raw, hscanCursorVersion, byte(len(c.id)))
+	raw = append(raw, c.id...)
+	raw = append(raw, c.field...)
+	b := make([]byte, base64.RawURLEncoding.EncodedLen(len(raw)))
+	base64.RawURLEncoding.Encode(b, raw)
+	return b
+}
+
+// Progress estimates the fraction of the scan completed before cursor by reading the field it points at
+// as a fraction of the byte-wise key space. It assumes the fields spread evenly over that space, so it
+// is only a hint for progress bars, but it never decreases during a scan and is 1 for a nil cursor
+func (c *HScanCursor) Progress() float64 {
+	if c == nil {
+		return 1
+	}
+	var p, unit float64 = 0, 1
+	for i := 0; i < len(c.field) && i < 8; i++ {
+		unit /= 256
+		p += float64(c.field[i]) * unit
+	}
+	return p
+}
+
+// HScan iterates the fields of the hash from cursor, it examines at most count fields and returns the ones
+// matching the glob-style pattern and the cursor to continue with, the returned cursor is nil when the scan
+// is complete. So a call may return fewer than count fields, or none, before the scan is complete. A cursor
+// returned for another hash, e.g. one deleted and recreated at the key since, fails with ErrStaleCursor
+func (hash *Hash) HScan(cursor *HScanCursor, match []byte, count int64) (*HScanCursor, [][]byte, [][]byte, error) {
+	return hash.HScanWhere(cursor, match, count, nil)
+}
+
+// HScanWhere iterates the fields of the hash like HScan, the fields matching the pattern are only returned
+// if valuePred accepts their values. A nil valuePred accepts all values
+func (hash *Hash) HScanWhere(cursor *HScanCursor, match []byte, count int64, valuePred func([]byte) bool) (*HScanCursor, [][]byte, [][]byte, error) {
+	if cursor != nil && len(cursor.id) > 0 && !bytes.Equal(cursor.id, hash.meta.ID) {
+		return nil, nil, nil, ErrStaleCursor
+	}
+	if count <= 0 {
+		count = defaultHScanCount
+	}
+	all := len(match) == 0 || (len(match) == 1 && match[0] == '*')
+	mprefix := GlobMatchPrefix(match)
+
+	start := mprefix
+	if cursor != nil && bytes.Compare(cursor.field, mprefix) > 0 {
+		start = cursor.field
+	}
+	it, err := hash.iterFrom(start)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer it.close()
+
+	var fields [][]byte
+	var vals [][]byte
+	it.limit = count
+	if err := it.walk(func() (bool, error) {
+		field := it.field()
+		// fields sharing the literal prefix of the pattern are contiguous
+		if !bytes.HasPrefix(field, mprefix) {
+			return false, nil
+		}
+		if all || GlobMatch(match, field, true) {
+			val, err := it.value()
+			if err != nil {
+				return false, err
+			}
+			if valuePred == nil || valuePred(val) {
+				fields = append(fields, field)
+				vals = append(vals, val)
+			}
+		}
+		return true, nil
+	}); err != nil {
+		return nil, nil, nil, err
+	}
+	// stopped by count before the fields sharing the prefix are exhausted
+	if it.valid() && bytes.HasPrefix(it.field(), mprefix) {
+		return &HScanCursor{id: hash.meta.ID, field: it.field()}, fields, vals, nil
+	}
+	return nil, fields, vals, nil
+}
+
+// touch records a change of the content of the hash, the meta is written by the caller
+func (hash *Hash) touch() {
+	if hash.meta.Flags&HashFlagFrozenTime != 0 {
+		return
+	}
+	hash.meta.UpdatedAt = Now()
+}
+
+// FreezeTimestamps stops the writes to the hash from updating its UpdatedAt, so the ETag of a write-once
+// hash stays stable. Len and the values are still maintained. The name differs from Freeze, which stores
+// the content of the hash as a blob. It fails with ErrKeyNotFound if the hash does not exist
+func (hash *Hash) FreezeTimestamps() error {
+	if hash.rawMeta == nil && !hash.metaDirty {
+		return ErrKeyNotFound
+	}
+	if hash.meta.Flags&HashFlagFrozenTime != 0 {
+		return nil
+	}
+	hash.meta.Flags |= HashFlagFrozenTime
+	return hash.updateMeta()
+}
+
+// UnfreezeTimestamps makes the writes to the hash update its UpdatedAt again
+func (hash *Hash) UnfreezeTimestamps() error {
+	if hash.meta.Flags&HashFlagFrozenTime == 0 {
+		return nil
+	}
+	hash.meta.Flags &^= HashFlagFrozenTime
+	return hash.updateMeta()
+}
+
+// ETag returns a weak validator of the content of the hash, it is derived from the object ID, Len and the
+// time of the last change, so it stays the same until the fields are changed. Writes which leave all values
+// as they were do not change it. A missing hash has a fixed tag
+func (hash *Hash) ETag() (string, error) {
+	if hash.rawMeta == nil {
+		return `W/"0"`, nil
+	}
+	return fmt.Sprintf(`W/"%x-%x-%x"`, hash.meta.ID, hash.meta.Len, hash.meta.UpdatedAt), nil
+}
+
+// SetLabel attaches a label to the hash stored at key, the labels are kept in the meta apart from the fields
+// and go away with the hash. An empty value removes the label. It fails with ErrKeyNotFound if the hash does
+// not exist, and with ErrLabelsTooLarge if the labels would exceed 1KB in total
+func (hash *Hash) SetLabel(key, value string) error {
+	if hash.rawMeta == nil && !hash.metaDirty {
+		return ErrKeyNotFound
+	}
+	if value == "" {
+		if _, ok := hash.meta.Labels[key]; !ok {
+			return nil
+		}
+		delete(hash.meta.Labels, key)
+		if len(hash.meta.Labels) == 0 {
+			hash.meta.Labels = nil
+		}
+		return hash.updateMeta()
+	}
+	size := len(key) + len(value)
+	for k, v := range hash.meta.Labels {
+		if k != key {
+			size += len(k) + len(v)
+		}
+	}
+	if size > hashLabelsMaxBytes {
+		return ErrLabelsTooLarge
+	}
+	if hash.meta.Labels == nil {
+		hash.meta.Labels = make(map[string]string)
+	}
+	hash.meta.Labels[key] = value
+	return hash.updateMeta()
+}
+
+// Labels returns a copy of the labels of the hash stored at key, a missing hash has no labels
+func (hash *Hash) Labels() (map[string]string, error) {
+	labels := make(map[string]string, len(hash.meta.Labels))
+	for k, v := range hash.meta.Labels {
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// intercept passes a write of a key of the hash to the write interceptor of the transaction
+func (hash *Hash) intercept(op WriteOp, key, value []byte) error {
+	if w := hash.txn.interceptor; w != nil {
+		return w.BeforeWrite(op, key, value)
+	}
+	return nil
+}
+
+// set writes a key of the hash through the write interceptor of the transaction
+func (hash *Hash) set(key []byte, value []byte) error {
+	if err := hash.intercept(WriteSet, key, value); err != nil {
+		return err
+	}
+	return hash.storeFor(key).Set(key, value)
+}
+
+// delete removes a key of the hash through the write interceptor of the transaction
+func (hash *Hash) delete(key []byte) error {
+	if err := hash.intercept(WriteDelete, key, nil); err != nil {
+		return err
+	}
+	return hash.storeFor(key).Delete(key)
+}
+
+func (hash *Hash) updateMeta() error {
+	if hash.deferMeta {
+		hash.metaDirty = true
+		return nil
+	}
+	return hash.writeMeta()
+}
+
+// flushMeta writes the meta held back by deferMeta
+func (hash *Hash) flushMeta() error {
+	hash.deferMeta = false
+	if !hash.metaDirty {
+		return nil
+	}
+	hash.metaDirty = false
+	return hash.writeMeta()
+}
+
+func (hash *Hash) writeMeta() error {
+	if err := hash.syncInline(); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(hash.meta)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(meta, hash.rawMeta) {
+		return nil
+	}
+	if err := hash.set(MetaKey(hash.txn.db, hash.key), meta); err != nil {
+		return err
+	}
+	hash.rawMeta = meta
+	return nil
+}
+
+// Destory the hash store
+func (hash *Hash) Destory() error {
+	hash.rawMeta = nil
+	hash.metaDirty = false
+	if err := hash.txn.Destory(&hash.meta.Object, hash.key); err != nil {
+		return err
+	}
+	// the data of the old ID is left to GC, so the fields written by a later call go under a new one
+	hash.reset()
+	return nil
+}
+
+// HExists returns if field is an existing field in the hash stored at key
+func (hash *Hash) HExists(field []byte) (bool, error) {
+	if hash.bloomRejects(field) {
+		return false, nil
+	}
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	ikey := hashItemKey(dkey, field)
+	if _, err := hash.r().Get(ikey); err != nil {
+		if IsErrNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// HAnyExists returns if any of fields is an existing field in the hash stored at key, the fields are
+// checked with a single batch read
+func (hash *Hash) HAnyExists(fields [][]byte) (bool, error) {
+	return hash.anyExistence(fields, true)
+}
+
+// HAllExist returns if all of fields are existing fields in the hash stored at key, the fields are
+// checked with a single batch read
+func (hash *Hash) HAllExist(fields [][]byte) (bool, error) {
+	missing, err := hash.anyExistence(fields, false)
+	return !missing, err
+}
+
+// anyExistence returns if the existence of any of fields is exist, it stops at the first such field. The
+// fields ruled out by the bloom filter are not read, and the store can not batch read keys without their
+// values, so the values of the rest are fetched but never kept
+func (hash *Hash) anyExistence(fields [][]byte, exist bool) (bool, error) {
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	var ikeys [][]byte
+	for _, field := range fields {
+		if hash.bloomRejects(field) {
+			if !exist {
+				return true, nil
+			}
+			continue
+		}
+		ikeys = append(ikeys, hashItemKey(dkey, field))
+	}
+	if len(ikeys) == 0 {
+		return false, nil
+	}
+	if hash.inline != nil {
+		for _, ikey := range ikeys {
+			_, err := hash.inline.Get(ikey)
+			if err != nil && !IsErrNotFound(err) {
+				return false, err
+			}
+			if (err == nil) == exist {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	kvs, err := store.BatchGetValues(hash.txn.t, ikeys)
+	if err != nil {
+		return false, err
+	}
+	for _, ikey := range ikeys {
+		if _, ok := kvs[string(ikey)]; ok == exist {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HIncrBy increments the number stored at field in the hash stored at key by increment
+func (hash *Hash) HIncrBy(field []byte, v int64) (int64, error) {
+	return hash.HIncrByWithDefault(field, v, 0)
+}
+
+// HIncrByMany increments the numbers stored at fields in the hash stored at key by their deltas like HIncrBy,
+// a repeated field is incremented once per occurrence. The fields are read and written in batches and the
+// meta is written once. It returns the resulting number of every field in the order of fields, an overflow
+// is a *FieldError wrapping ErrInteger and nothing is written then
+func (hash *Hash) HIncrByMany(fields [][]byte, deltas []int64) ([]int64, error) {
+	if len(fields) != len(deltas) {
+		return nil, ErrLengthMismatch
+	}
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	if err := checkFields(fields...); err != nil {
+		return nil, err
+	}
+	index := make(map[string]int, len(fields))
+	var distinct [][]byte
+	for _, field := range fields {
+		if _, ok := index[string(field)]; !ok {
+			index[string(field)] = len(distinct)
+			distinct = append(distinct, field)
+		}
+	}
+	olds, err := hash.HMGet(distinct)
+	if err != nil {
+		return nil, err
+	}
+	nums := make([]int64, len(distinct))
+	for i, old := range olds {
+		if old == nil {
+			continue
+		}
+		if nums[i], err = strconv.ParseInt(string(old), 10, 64); err != nil {
+			return nil, &FieldError{Field: distinct[i], Err: ErrNotAnInteger}
+		}
+	}
+	results := make([]int64, len(fields))
+	for i, field := range fields {
+		j := index[string(field)]
+		n := nums[j] + deltas[i]
+		if (deltas[i] > 0 && n < nums[j]) || (deltas[i] < 0 && n > nums[j]) {
+			return nil, &FieldError{Field: field, Err: ErrInteger}
+		}
+		nums[j], results[i] = n, n
+	}
+	vals := make([][]byte, len(distinct))
+	for i, n := range nums {
+		vals[i] = []byte(strconv.FormatInt(n, 10))
+	}
+	if err := hash.hmset(distinct, vals, olds); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// HIncrByWithDefault increments the number stored at field in the hash stored at key by increment,
+// a missing field is treated as holding def. An overflow is a *FieldError wrapping ErrInteger and nothing
+// is written then
+func (hash *Hash) HIncrByWithDefault(field []byte, v, def int64) (int64, error) {
+	if err := checkFields(field); err != nil {
+		return 0, err
+	}
+	old, err := hash.HGet(field)
+	if err != nil {
+		return 0, err
+	}
+	n := def
+	if old != nil {
+		if n, err = strconv.ParseInt(string(old), 10, 64); err != nil {
+			return 0, &FieldError{Field: field, Err: ErrNotAnInteger}
+		}
+	}
+	if (v > 0 && n+v < n) || (v < 0 && n+v > n) {
+		return 0, &FieldError{Field: field, Err: ErrInteger}
+	}
+	n += v
+	if _, err := hash.hset(field, []byte(strconv.FormatInt(n, 10)), old); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// HIncrByFloat increment the specified field of a hash stored at key,
+// and representing a floating point number, by the specified increment
+func (hash *Hash) HIncrByFloat(field []byte, v float64) (float64, error) {
+	if err := checkFields(field); err != nil {
+		return 0, err
+	}
+	old, err := hash.HGet(field)
+	if err != nil {
+		return 0, err
+	}
+	var n float64
+	if old != nil {
+		if n, err = strconv.ParseFloat(string(old), 64); err != nil {
+			return 0, &FieldError{Field: field, Err: ErrNotAFloat}
+		}
+	}
+	n += v
+	if _, err := hash.hset(field, []byte(strconv.FormatFloat(n, 'f', -1, 64)), old); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// CachedLen returns the number of fields recorded in the loaded meta without reading the store. Unlike HLen
+// it is never verified by read repair, so it may be stale if the stored count has drifted
+func (hash *Hash) CachedLen() int64 {
+	return hash.meta.Len
+}
+
+// HLen returns the number of fields contained in the hash stored at key, see SetReadRepair for the
+// verification of the stored count
+func (hash *Hash) HLen() int64 {
+	if readRepairThreshold < 0 || hash.rawMeta == nil {
+		return hash.meta.Len
+	}
+	n, err := hash.HLenVerified()
+	if err != nil {
+		zap.L().Warn("verify hash len failed", zap.ByteString("key", hash.key), zap.Error(err))
+		return hash.meta.Len
+	}
+	drift := n - hash.meta.Len
+	if drift < 0 {
+		drift = -drift
+	}
+	if drift <= readRepairThreshold {
+		return hash.meta.Len
+	}
+	zap.L().Warn("repair drifted hash len", zap.ByteString("key", hash.key),
+		zap.Int64("stored", hash.meta.Len), zap.Int64("verified", n))
+	hash.meta.Len = n
+	if n == 0 {
+		err = hash.Destory()
+	} else {
+		err = hash.updateMeta()
+	}
+	if err != nil {
+		zap.L().Warn("repair hash len failed", zap.ByteString("key", hash.key), zap.Error(err))
+	}
+	return n
+}
+
+// HLenVerified counts the fields of the hash stored at key from the item keys instead of trusting the stored Len
+func (hash *Hash) HLenVerified() (int64, error) {
+	it, err := hash.iter()
+	if err != nil {
+		return 0, err
+	}
+	defer it.close()
+
+	var n int64
+	if err := it.walk(func() (bool, error) {
+		n++
+		return true, nil
+	}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// SelfCheck compares the meta of the hash stored at key with the keys of its data and returns every
+// inconsistency found: a Len or Bytes not matching the fields, data keys left in the store by an inline hash
+// or inline entries kept by a plain hash table, malformed keys, and sub keys of disabled features or of
+// missing fields. It reads all keys of the hash and is meant for tests and diagnosis
+func (hash *Hash) SelfCheck() []error {
+	var errs []error
+	if err := hash.Validate(); err != nil {
+		errs = append(errs, err)
+	}
+	// the keys in the store are read even for an inline hash, which must have none
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	it, err := seekHashIter(hash.txn.t, dkey, dkey, hash.meta.Flags)
+	if err != nil {
+		return append(errs, err)
+	}
+	defer it.close()
+	var entries []inlineEntry
+	if err := it.walk(func() (bool, error) {
+		entries = append(entries, inlineEntry{K: append([]byte{}, it.key()...), V: it.raw()})
+		return true, nil
+	}); err != nil {
+		return append(errs, err)
+	}
+	if hash.inline != nil {
+		if len(entries) != 0 {
+			errs = append(errs, fmt.Errorf("inline hash has %d keys in the store", len(entries)))
+		}
+		entries = hash.inline.Entries
+	} else if len(hash.meta.Inline) != 0 {
+		errs = append(errs, fmt.Errorf("plain hash table keeps %d inline entries", len(hash.meta.Inline)))
+	}
+
+	type subKey struct {
+		inlineEntry
+		tag byte
+		sub []byte
+	}
+	var size int64
+	var subKeys []subKey
+	var order []string
+	var values [][]byte
+	fields := make(map[string]bool)
+	subs := make(map[byte]map[string][]byte)
+	for _, e := range entries {
+		if tag, sub, ok := decodeHashSubKey(dkey, e.K); ok {
+			if subs[tag] == nil {
+				subs[tag] = make(map[string][]byte)
+			}
+			subs[tag][string(sub)] = e.V
+			subKeys = append(subKeys, subKey{inlineEntry: e, tag: tag, sub: sub})
+			continue
+		}
+		field, err := DecodeHashItemKey(dkey, e.K)
+		if err != nil {
+			errs = append(errs, &KeyError{Key: e.K, Err: err})
+			continue
+		}
+		n, err := hashValueLen(hash.meta.Flags, e.V)
+		if err != nil {
+			errs = append(errs, &FieldError{Field: field, Err: err})
+		}
+		fields[string(field)] = true
+		order = append(order, string(field))
+		values = append(values, e.V)
+		size += int64(len(field)) + n
+	}
+	if int64(len(fields)) != hash.meta.Len {
+		errs = append(errs, fmt.Errorf("len %d does not match %d fields", hash.meta.Len, len(fields)))
+	}
+	if hash.meta.Flags&HashFlagSized != 0 && size != hash.meta.Bytes {
+		errs = append(errs, fmt.Errorf("bytes %d does not match %d bytes of fields", hash.meta.Bytes, size))
+	}
+
+	flags := map[byte]HashFlag{
+		hashSubOrder:      HashFlagInsertionOrder,
+		hashSubOrderField: HashFlagInsertionOrder,
+		hashSubVersion:    HashFlagVersioning,
+		hashSubTime:       HashFlagFieldTime,
+		hashSubValue:      HashFlagUniqueValues,
+	}
+	for _, e := range subKeys {
+		flag, ok := flags[e.tag]
+		if !ok {
+			errs = append(errs, &KeyError{Key: e.K, Err: errors.New("sub key of an unknown tag")})
+			continue
+		}
+		if hash.meta.Flags&flag == 0 {
+			errs = append(errs, &KeyError{Key: e.K, Err: errors.New("sub key of a disabled feature")})
+			continue
+		}
+		field := string(e.sub)
+		if e.tag == hashSubOrder || e.tag == hashSubValue {
+			field = string(e.V)
+		}
+		if !fields[field] {
+			errs = append(errs, &KeyError{Key: e.K, Err: errors.New("sub key of a missing field")})
+		}
+	}
+	if hash.meta.Flags&HashFlagInsertionOrder != 0 {
+		for _, field := range order {
+			seq, ok := subs[hashSubOrderField][field]
+			if !ok || string(subs[hashSubOrder][string(seq)]) != field {
+				errs = append(errs, &FieldError{Field: []byte(field), Err: errors.New("field is missing in the insertion order")})
+			}
+		}
+	}
+	if hash.meta.Flags&HashFlagUniqueValues != 0 {
+		for i, field := range order {
+			val, err := decodeHashValue(hash.meta.Flags, values[i])
+			if err != nil {
+				continue
+			}
+			if owner, ok := subs[hashSubValue][string(val)]; !ok || string(owner) != field {
+				errs = append(errs, &FieldError{Field: []byte(field), Err: errors.New("field is missing in the index of values")})
+			}
+		}
+	}
+	return errs
+}
+
+// CreatedTime returns the creation time of the hash, meta.CreatedAt holds the unix nano timestamp of Now
+func (hash *Hash) CreatedTime() time.Time {
+	return time.Unix(0, hash.meta.CreatedAt)
+}
+
+// MemoryUsage returns the total size of the fields and their values in the hash stored at key. It is kept in
+// the meta for the hashes created with HashFlagSized, the older hashes are scanned
+func (hash *Hash) MemoryUsage() (int64, error) {
+	if hash.meta.Flags&HashFlagSized != 0 {
+		return hash.meta.Bytes, nil
+	}
+	fields, vals, err := hash.HGetAll()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for i := range fields {
+		n += int64(len(fields[i]) + len(vals[i]))
+	}
+	return n, nil
+}
+
+// HLenOrMissing returns the number of fields contained in the hash stored at key and true if the key exists,
+// or -1 and false if it does not exist. A meta held back by WithHashes counts as existing
+func (hash *Hash) HLenOrMissing() (int64, bool, error) {
+	if hash.rawMeta == nil && !hash.metaDirty {
+		return -1, false, nil
+	}
+	return hash.meta.Len, true, nil
+}
+
+// HMGet returns the values associated with the specified fields in the hash stored at key
+func (hash *Hash) HMGet(fields [][]byte) ([][]byte, error) {
+	if len(fields) == 0 {
+		return [][]byte{}, nil
+	}
+	ikeys := make([][]byte, len(fields))
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	for i := range fields {
+		ikeys[i] = hashItemKey(dkey, fields[i])
+	}
+
+	vals, err := hash.batchGet(ikeys)
+	if err != nil {
+		return nil, err
+	}
+	return decodeHashValues(hash.meta.Flags, vals)
+}
+
+// HMSet sets the specified fields to their respective values in the hash stored at key, the last value
+// of a repeated field wins. The writes of the fields are staged and passed to the write interceptor before
+// any of them is applied, if the store fails to apply one the fields written before it are restored.
+// It fails with ErrLengthMismatch if fields and values differ in length
+func (hash *Hash) HMSet(fields [][]byte, values [][]byte) error {
+	if len(fields) != len(values) {
+		return ErrLengthMismatch
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	if err := checkFields(fields...); err != nil {
+		return err
+	}
+	if err := checkValueSize(values...); err != nil {
+		return err
+	}
+	fields, values = dedupeFields(fields, values)
+	oldValues, err := hash.HMGet(fields)
+	if err != nil {
+		return err
+	}
+	return hash.hmset(fields, values, oldValues)
+}
+
+// hmset sets the distinct fields from oldValues to values, a nil old value means the field is missing
+func (hash *Hash) hmset(fields, values, oldValues [][]byte) error {
+	var num int64
+	var changed bool
+	for i := range fields {
+		if oldValues[i] == nil {
+			num++
+		}
+		if !bytes.Equal(oldValues[i], values[i]) {
+			changed = true
+		}
+	}
+	if err := hash.checkMaxFields(num); err != nil {
+		return err
+	}
+	if err := hash.checkUniqueValues(fields, values); err != nil {
+		return err
+	}
+
+	// a veto of the interceptor comes before any write, so it leaves the transaction unchanged
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	ikeys := make([][]byte, len(fields))
+	encoded := make([][]byte, len(fields))
+	for i := range fields {
+		ikeys[i] = hashItemKey(dkey, fields[i])
+		encoded[i] = hash.encodeValue(values[i])
+		if err := hash.intercept(WriteSet, ikeys[i], encoded[i]); err != nil {
+			return err
+		}
+	}
+	for i := range ikeys {
+		if err := hash.storeFor(ikeys[i]).Set(ikeys[i], encoded[i]); err != nil {
+			// leave no field of a failed call in the transaction, a failed restore leaves the transaction
+			// in an unknown state so the caller must roll it back
+			if rerr := hash.restoreValues(ikeys[:i], oldValues[:i]); rerr != nil {
+				zap.L().Warn("restore hash values failed", zap.ByteString("key", hash.key), zap.Error(rerr))
+				return &RestoreError{Err: err, RestoreErr: rerr}
+			}
+			return err
+		}
+	}
+	for i := range fields {
+		if err := hash.fieldWritten(fields[i]); err != nil {
+			return err
+		}
+		if err := hash.valueIndexed(fields[i], oldValues[i], values[i]); err != nil {
+			return err
+		}
+		hash.resized(fields[i], oldValues[i], values[i])
+		if oldValues[i] == nil {
+			if err := hash.fieldAdded(fields[i]); err != nil {
+				return err
+			}
+		}
+	}
+
+	hash.meta.Len += num
+	if changed {
+		hash.touch()
+	}
+	return hash.updateMeta()
+}
+
+// dedupeFields keeps the last value of a field repeated in fields, the fields stay in the order of their
+// first occurrences
+func dedupeFields(fields, values [][]byte) ([][]byte, [][]byte) {
+	if len(fields) < 2 {
+		return fields, values
+	}
+	index := make(map[string]int, len(fields))
+	dfields := make([][]byte, 0, len(fields))
+	dvalues := make([][]byte, 0, len(fields))
+	for i, field := range fields {
+		if j, ok := index[string(field)]; ok {
+			dvalues[j] = values[i]
+			continue
+		}
+		index[string(field)] = len(dfields)
+		dfields = append(dfields, field)
+		dvalues = append(dvalues, values[i])
+	}
+	return dfields, dvalues
+}
+
+// restoreValues puts the old values back to the item keys through the write interceptor, a nil value
+// removes the key
+func (hash *Hash) restoreValues(ikeys [][]byte, olds [][]byte) error {
+	for i := len(ikeys) - 1; i >= 0; i-- {
+		var err error
+		if olds[i] == nil {
+			err = hash.delete(ikeys[i])
+		} else {
+			err = hash.setValue(ikeys[i], olds[i])
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if hash.inline != nil {
+		return hash.updateMeta()
+	}
+	return nil
+}
+
+// BulkLoad sets the specified fields to their respective values in the hash stored at key for the initial load.
+// If assumeNew is set, the caller guarantees the hash is new and the fields are distinct, so the fields are
+// written without checking for their existence and Len is set directly
+func (hash *Hash) BulkLoad(fields [][]byte, values [][]byte, assumeNew bool) error {
+	if len(fields) != len(values) {
+		return ErrLengthMismatch
+	}
+	if !assumeNew || hash.meta.Len != 0 {
+		return hash.HMSet(fields, values)
+	}
+	if err := checkFields(fields...); err != nil {
+		return err
+	}
+	if err := checkValueSize(values...); err != nil {
+		return err
+	}
+	if err := hash.checkMaxFields(int64(len(fields))); err != nil {
+		return err
+	}
+	if err := hash.checkUniqueValues(fields, values); err != nil {
+		return err
+	}
+
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	for i := range fields {
+		if err := hash.setValue(hashItemKey(dkey, fields[i]), values[i]); err != nil {
+			return err
+		}
+		if err := hash.fieldWritten(fields[i]); err != nil {
+			return err
+		}
+		if err := hash.valueIndexed(fields[i], nil, values[i]); err != nil {
+			return err
+		}
+		if err := hash.fieldAdded(fields[i]); err != nil {
+			return err
+		}
+		hash.resized(fields[i], nil, values[i])
+	}
+	hash.meta.Len = int64(len(fields))
+	hash.touch()
 	return hash.updateMeta()
 }
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"hash/fnv"
+)
+
+// hashBloomHashes is the number of bits set in the bloom filter for a field
+const hashBloomHashes = 4
+
+// hashBloomMaxBits is the largest bloom filter a hash can keep, the filter lives in the meta and is
+// written back with it on every write to the hash
+const hashBloomMaxBits = 1 << 16
+
+// EnableBloomFilter keeps a bloom filter of bits bits of the fields in the meta of the hash, so HGet and
+// HExists answer a missing field without reading the store when the filter rules it out. The existing
+// fields are added to the filter by scanning the hash once. A field can not be removed from a bloom filter,
+// so the deleted fields stay as false positives that cost the real lookup until the hash is recreated.
+// It fails with ErrKeyNotFound if the hash does not exist, and with ErrOutOfRange if bits is not positive
+// or larger than hashBloomMaxBits
+func (hash *Hash) EnableBloomFilter(bits int) error {
+	if hash.rawMeta == nil && !hash.metaDirty {
+		return ErrKeyNotFound
+	}
+	if hash.meta.Flags&HashFlagBloom != 0 {
+		return nil
+	}
+	if bits <= 0 || bits > hashBloomMaxBits {
+		return ErrOutOfRange
+	}
+	it, err := hash.iter()
+	if err != nil {
+		return err
+	}
+	defer it.close()
+
+	hash.meta.Bloom = make([]byte, (bits+7)/8)
+	if err := it.walk(func() (bool, error) {
+		hash.bloomAdd(it.field())
+		return true, nil
+	}); err != nil {
+		hash.meta.Bloom = nil
+		return err
+	}
+	hash.meta.Flags |= HashFlagBloom
+	return hash.updateMeta()
+}
+
+// bloomBits returns the bits of the bloom filter for field
+func bloomBits(size int, field []byte) [hashBloomHashes]uint64 {
+	h := fnv.New64a()
+	h.Write(field)
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	var bits [hashBloomHashes]uint64
+	for i := range bits {
+		bits[i] = (h1 + uint64(i)*h2) % uint64(size*8)
+	}
+	return bits
+}
+
+// bloomAdd adds field to the bloom filter of the hash, the meta is written by the caller
+func (hash *Hash) bloomAdd(field []byte) {
+	if len(hash.meta.Bloom) == 0 {
+		return
+	}
+	for _, bit := range bloomBits(len(hash.meta.Bloom), field) {
+		hash.meta.Bloom[bit/8] |= 1 << (bit % 8)
+	}
+}
+
+// bloomRejects returns if field is surely missing from the hash according to its bloom filter
+func (hash *Hash) bloomRejects(field []byte) bool {
+	if hash.meta.Flags&HashFlagBloom == 0 || len(hash.meta.Bloom) == 0 {
+		return false
+	}
+	for _, bit := range bloomBits(len(hash.meta.Bloom), field) {
+		if hash.meta.Bloom[bit/8]&(1<<(bit%8)) == 0 {
+			return true
+		}
+	}
+	return false
+}
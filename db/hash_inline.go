@@ -0,0 +1,162 @@
+package db
+
+import (
+	"bytes"
+
+	"github.com/meitu/titan/db/store"
+	"github.com/pingcap/tidb/kv"
+)
+
+var (
+	// inlineMaxFields and inlineMaxBytes bound the hashes kept inline in the meta, 0 disables inline hashes
+	inlineMaxFields int
+	inlineMaxBytes  int
+)
+
+// SetInlineHashLimits makes the new hashes keep their fields inline in the meta while they have at most
+// fields fields and bytes bytes of fields and values, like the listpack encoding of redis. A hash is converted
+// to a plain hash table once it grows beyond either limit, and back when HDel shrinks it below the limits.
+// It is disabled if any limit is 0
+func SetInlineHashLimits(fields, bytes int) {
+	inlineMaxFields = fields
+	inlineMaxBytes = bytes
+}
+
+// inlineEntry is a data key of an inline hash, K is the key with the data key of the hash stripped
+type inlineEntry = store.Entry
+
+// inlineStore holds the data keys of an inline hash sorted in memory and serves them in place of the store
+type inlineStore struct {
+	dkey []byte
+	store.SortedKV
+}
+
+func newInlineStore(dkey []byte, entries []inlineEntry) *inlineStore {
+	s := &inlineStore{dkey: dkey}
+	for _, e := range entries {
+		s.Entries = append(s.Entries, inlineEntry{K: append(append([]byte{}, dkey...), e.K...), V: e.V})
+	}
+	return s
+}
+
+// owns returns if key is stored inline
+func (s *inlineStore) owns(key []byte) bool {
+	return bytes.HasPrefix(key, s.dkey)
+}
+
+// fits returns if the entries are within the limits of inline hashes
+func (s *inlineStore) fits() bool {
+	if inlineMaxFields <= 0 || inlineMaxBytes <= 0 {
+		return false
+	}
+	prefix := hashItemKey(s.dkey, nil)
+	fields, size := 0, 0
+	for _, e := range s.Entries {
+		if bytes.HasPrefix(e.K, prefix) {
+			fields++
+		}
+		size += len(e.K) - len(s.dkey) + len(e.V)
+	}
+	return fields <= inlineMaxFields && size <= inlineMaxBytes
+}
+
+// encode returns the entries to be kept in the meta
+func (s *inlineStore) encode() []inlineEntry {
+	entries := make([]inlineEntry, len(s.Entries))
+	for i, e := range s.Entries {
+		entries[i] = inlineEntry{K: e.K[len(s.dkey):], V: e.V}
+	}
+	return entries
+}
+
+// r returns where the data keys of the hash are read from
+func (hash *Hash) r() kv.RetrieverMutator {
+	if hash.inline != nil {
+		return hash.inline
+	}
+	return hash.txn.t
+}
+
+// storeFor returns where key of the hash is written to
+func (hash *Hash) storeFor(key []byte) kv.RetrieverMutator {
+	if hash.inline != nil && hash.inline.owns(key) {
+		return hash.inline
+	}
+	return hash.txn.t
+}
+
+// batchGet returns the values of keys, the value is nil for a missing key
+func (hash *Hash) batchGet(keys [][]byte) ([][]byte, error) {
+	if hash.inline == nil {
+		return BatchGetValues(hash.txn, keys)
+	}
+	vals := make([][]byte, len(keys))
+	for i, key := range keys {
+		val, err := hash.inline.Get(key)
+		if err != nil && !IsErrNotFound(err) {
+			return nil, err
+		}
+		vals[i] = val
+	}
+	return vals, nil
+}
+
+// syncInline keeps the inline entries in the meta, the hash is converted to a plain hash table with the entries
+// written to the store once they are beyond the limits of inline hashes. The writes to the inline entries are
+// only kept in memory until the meta is written, so every write of the hash ends with updateMeta
+func (hash *Hash) syncInline() error {
+	s := hash.inline
+	if s == nil {
+		return nil
+	}
+	if s.fits() {
+		hash.meta.Inline = s.encode()
+		return nil
+	}
+	// the entries are no longer owned by the inline store, so set writes them to the store
+	hash.inline = nil
+	for _, e := range s.Entries {
+		if err := hash.set(e.K, e.V); err != nil {
+			hash.inline = s
+			return err
+		}
+	}
+	hash.meta.Inline = nil
+	hash.meta.Encoding = ObjectEncodingHT
+	return nil
+}
+
+// downgrade moves the data keys of a plain hash table back into the meta once the hash has shrunk below the
+// limits of inline hashes, the meta is written by the caller
+func (hash *Hash) downgrade() error {
+	if hash.inline != nil || inlineMaxFields <= 0 || hash.meta.Len >= int64(inlineMaxFields) {
+		return nil
+	}
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	iter, err := hash.txn.t.Seek(dkey)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+	s := &inlineStore{dkey: dkey}
+	for iter.Valid() && iter.Key().HasPrefix(dkey) {
+		s.Entries = append(s.Entries, inlineEntry{K: append([]byte{}, iter.Key()...), V: append([]byte{}, iter.Value()...)})
+		if err := iter.Next(); err != nil {
+			return err
+		}
+	}
+	if err := iterErr(iter); err != nil {
+		return err
+	}
+	if !s.fits() {
+		return nil
+	}
+	for _, e := range s.Entries {
+		if err := hash.delete(e.K); err != nil {
+			return err
+		}
+	}
+	hash.inline = s
+	hash.meta.Encoding = ObjectEncodingListpack
+	return nil
+}
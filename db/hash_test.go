@@ -0,0 +1,3833 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	jerrors "github.com/juju/errors"
+	"github.com/meitu/titan/db/store"
+	"github.com/pingcap/tidb/kv"
+	"github.com/stretchr/testify/assert"
+)
+
+var errInjected = errors.New("injected store error")
+
+// faultTxn wraps a store transaction so tests can inject failures
+type faultTxn struct {
+	store.Transaction
+	seek func(txn store.Transaction, k kv.Key) (kv.Iterator, error)
+	set  func(txn store.Transaction, k kv.Key, v []byte) error
+	get  func(txn store.Transaction, k kv.Key) ([]byte, error)
+	// seekReverse replaces the reverse seeks, which the store does not implement
+	seekReverse func(txn store.Transaction, k kv.Key) (kv.Iterator, error)
+}
+
+func (f *faultTxn) SeekReverse(k kv.Key) (kv.Iterator, error) {
+	if f.seekReverse != nil {
+		return f.seekReverse(f.Transaction, k)
+	}
+	return f.Transaction.SeekReverse(k)
+}
+
+func (f *faultTxn) Get(k kv.Key) ([]byte, error) {
+	if f.get != nil {
+		return f.get(f.Transaction, k)
+	}
+	return f.Transaction.Get(k)
+}
+
+func (f *faultTxn) Set(k kv.Key, v []byte) error {
+	if f.set != nil {
+		return f.set(f.Transaction, k, v)
+	}
+	return f.Transaction.Set(k, v)
+}
+
+func (f *faultTxn) Seek(k kv.Key) (kv.Iterator, error) {
+	if f.seek != nil {
+		return f.seek(f.Transaction, k)
+	}
+	return f.Transaction.Seek(k)
+}
+
+// faultIter yields n entries from the wrapped iterator, then fails
+type faultIter struct {
+	kv.Iterator
+	n       int
+	invalid bool // become invalid and report through Err instead of failing Next
+	err     error
+}
+
+func (it *faultIter) Valid() bool {
+	if it.invalid && it.err != nil {
+		return false
+	}
+	return it.Iterator.Valid()
+}
+
+func (it *faultIter) Next() error {
+	it.n--
+	if it.n <= 0 {
+		it.err = errInjected
+		if !it.invalid {
+			return it.err
+		}
+		return nil
+	}
+	return it.Iterator.Next()
+}
+
+func (it *faultIter) Err() error {
+	return it.err
+}
+
+// trackIter records whether the wrapped iterator is closed
+type trackIter struct {
+	kv.Iterator
+	closed bool
+}
+
+func (it *trackIter) Close() {
+	it.closed = true
+	it.Iterator.Close()
+}
+
+func setHashFields(t *testing.T, key []byte, fields, values [][]byte) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet(fields, values))
+	assert.NoError(t, txn.Commit(context.TODO()))
+}
+
+func TestHGetAllIteratorError(t *testing.T) {
+	key := []byte("hash-iter-error")
+	fields := [][]byte{[]byte("f1"), []byte("f2"), []byte("f3"), []byte("f4")}
+	values := [][]byte{[]byte("v1"), []byte("v2"), []byte("v3"), []byte("v4")}
+	setHashFields(t, key, fields, values)
+
+	for _, invalid := range []bool{false, true} {
+		txn, err := mockDB.Begin()
+		assert.NoError(t, err)
+		txn.t = &faultTxn{Transaction: txn.t, seek: func(t store.Transaction, k kv.Key) (kv.Iterator, error) {
+			iter, err := t.Seek(k)
+			if err != nil {
+				return nil, err
+			}
+			return &faultIter{Iterator: iter, n: 2, invalid: invalid}, nil
+		}}
+		hash, err := txn.Hash(key)
+		assert.NoError(t, err)
+
+		fs, vs, err := hash.HGetAll()
+		assert.Equal(t, errInjected, err)
+		assert.Nil(t, fs)
+		assert.Nil(t, vs)
+
+		// the variants share the iterator and fail the same way
+		_, _, err = hash.HGetAllExcept(nil)
+		assert.Equal(t, errInjected, err)
+		_, _, err = hash.HGetAllStrict()
+		assert.Equal(t, errInjected, err)
+		_, _, err = hash.HGetAllLazy()
+		assert.Equal(t, errInjected, err)
+		_, _, _, err = hash.HGetAllPacked()
+		assert.Equal(t, errInjected, err)
+		_, _, err = hash.HMGetMatch([]string{"f*"}, 0)
+		assert.Equal(t, errInjected, err)
+		_, err = hash.DistinctValueCount(0)
+		assert.Equal(t, errInjected, err)
+		assert.NoError(t, txn.Rollback())
+	}
+}
+
+func TestHTrim(t *testing.T) {
+	key := []byte("hash-trim")
+	fields := [][]byte{[]byte("d"), []byte("a"), []byte("c"), []byte("b"), []byte("e")}
+	values := [][]byte{[]byte("vd"), []byte("va"), []byte("vc"), []byte("vb"), []byte("ve")}
+	setHashFields(t, key, fields, values)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	removed, err := hash.HTrim(2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), removed)
+	removed, err = hash.HTrim(2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), removed)
+	_, err = hash.HTrim(-1)
+	assert.Equal(t, ErrOutOfRange, err)
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), hash.HLen())
+	fs, vs, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, fs)
+	assert.Equal(t, [][]byte{[]byte("va"), []byte("vb")}, vs)
+
+	removed, err = hash.HTrim(0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), removed)
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	_, err = txn.t.Get(MetaKey(txn.db, key))
+	assert.True(t, IsErrNotFound(err))
+	assert.NoError(t, txn.Rollback())
+}
+
+func TestHashUpdateMetaSkipsUnchanged(t *testing.T) {
+	key := []byte("hash-meta-unchanged")
+	setHashFields(t, key, [][]byte{[]byte("f")}, [][]byte{[]byte("v")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	mkey := MetaKey(txn.db, key)
+	metaWrites := 0
+	txn.t = &faultTxn{Transaction: txn.t, set: func(t store.Transaction, k kv.Key, v []byte) error {
+		if k.Cmp(mkey) == 0 {
+			metaWrites++
+		}
+		return t.Set(k, v)
+	}}
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("f")}, [][]byte{[]byte("v")}))
+	assert.Equal(t, 0, metaWrites)
+
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("g")}, [][]byte{[]byte("v")}))
+	assert.Equal(t, 1, metaWrites)
+	assert.Equal(t, int64(2), hash.HLen())
+	assert.NoError(t, txn.Rollback())
+}
+
+func TestHGetAllCorruptLen(t *testing.T) {
+	key := []byte("hash-corrupt-len")
+	fields := [][]byte{[]byte("f1"), []byte("f2"), []byte("f3")}
+	values := [][]byte{[]byte("v1"), []byte("v2"), []byte("v3")}
+	setHashFields(t, key, fields, values)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	hash.meta.Len = math.MaxInt64
+	assert.NoError(t, hash.updateMeta())
+
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), hash.HLen())
+	fs, vs, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+	assert.Equal(t, values, vs)
+	assert.True(t, cap(fs) < 1024)
+	assert.True(t, cap(vs) < 1024)
+	assert.NoError(t, txn.Rollback())
+}
+
+func TestHScanCursor(t *testing.T) {
+	c := &HScanCursor{id: UUID(), field: []byte("field:\x00\xff")}
+	got, err := ParseHScanCursor(c.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, c, got)
+
+	got, err = ParseHScanCursor([]byte("0"))
+	assert.NoError(t, err)
+	assert.Equal(t, &HScanCursor{}, got)
+	var end *HScanCursor
+	assert.Equal(t, []byte("0"), end.Bytes())
+
+	raw := append([]byte{hscanCursorVersion + 1}, "field"...)
+	stale := make([]byte, base64.RawURLEncoding.EncodedLen(len(raw)))
+	base64.RawURLEncoding.Encode(stale, raw)
+	_, err = ParseHScanCursor(stale)
+	assert.Equal(t, ErrStaleCursor, err)
+
+	_, err = ParseHScanCursor([]byte("!!"))
+	assert.Equal(t, ErrInvalidCursor, err)
+	raw = []byte{hscanCursorVersion, 16, 'x'}
+	truncated := make([]byte, base64.RawURLEncoding.EncodedLen(len(raw)))
+	base64.RawURLEncoding.Encode(truncated, raw)
+	_, err = ParseHScanCursor(truncated)
+	assert.Equal(t, ErrInvalidCursor, err)
+}
+
+func TestHScanResume(t *testing.T) {
+	key := []byte("hscan-resume")
+	var fields [][]byte
+	for i := 0; i < 6; i++ {
+		fields = append(fields, []byte(fmt.Sprintf("f%d", i)))
+	}
+	setHashFields(t, key, fields, fields)
+
+	scan := func(cursor []byte) ([]byte, [][]byte, error) {
+		// every call reads the hash from scratch as a restarted server would
+		txn, err := mockDB.Begin()
+		assert.NoError(t, err)
+		defer txn.Rollback()
+		hash, err := txn.Hash(key)
+		assert.NoError(t, err)
+		c, err := ParseHScanCursor(cursor)
+		if err != nil {
+			return nil, nil, err
+		}
+		next, fs, _, err := hash.HScan(c, nil, 4)
+		return next.Bytes(), fs, err
+	}
+
+	cursor, fs, err := scan([]byte("0"))
+	assert.NoError(t, err)
+	assert.Equal(t, fields[:4], fs)
+	next, fs, err := scan(cursor)
+	assert.NoError(t, err)
+	assert.Equal(t, fields[4:], fs)
+	assert.Equal(t, []byte("0"), next)
+
+	// the cursor of a deleted hash is stale for the one recreated at the key
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	assert.NoError(t, hash.Destory())
+	assert.NoError(t, txn.Commit(context.TODO()))
+	setHashFields(t, key, fields, fields)
+	_, _, err = scan(cursor)
+	assert.Equal(t, ErrStaleCursor, err)
+}
+
+func TestHScan(t *testing.T) {
+	key := []byte("hash-scan")
+	var fields, values [][]byte
+	for i := 0; i < 25; i++ {
+		fields = append(fields, []byte(fmt.Sprintf("f%02d", i)))
+		values = append(values, []byte(fmt.Sprintf("v%02d", i)))
+	}
+	fields = append(fields, []byte("other"))
+	values = append(values, []byte("other"))
+	setHashFields(t, key, fields, values)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	scan := func(match []byte, count int64) ([][]byte, [][]byte, int) {
+		var fs, vs [][]byte
+		calls := 0
+		cursor, err := ParseHScanCursor([]byte("0"))
+		assert.NoError(t, err)
+		for {
+			next, f, v, err := hash.HScan(cursor, match, count)
+			assert.NoError(t, err)
+			calls++
+			fs = append(fs, f...)
+			vs = append(vs, v...)
+			if next == nil {
+				break
+			}
+			cursor, err = ParseHScanCursor(next.Bytes())
+			assert.NoError(t, err)
+		}
+		return fs, vs, calls
+	}
+
+	fs, vs, calls := scan(nil, 10)
+	assert.Equal(t, fields, fs)
+	assert.Equal(t, values, vs)
+	assert.Equal(t, 3, calls)
+
+	fs, _, _ = scan([]byte("f1*"), 4)
+	assert.Equal(t, fields[10:20], fs)
+
+	fs, _, _ = scan([]byte("*er"), 4)
+	assert.Equal(t, [][]byte{[]byte("other")}, fs)
+}
+
+func TestHScanCountExamined(t *testing.T) {
+	key := []byte("hash-scan-count-examined")
+	var fields [][]byte
+	for i := 0; i < 10; i++ {
+		fields = append(fields, []byte(fmt.Sprintf("a%d", i)))
+	}
+	setHashFields(t, key, fields, fields)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	// a sparse pattern stops after count fields are examined
+	next, fs, _, err := hash.HScan(nil, []byte("*9"), 3)
+	assert.NoError(t, err)
+	assert.Empty(t, fs)
+	assert.Equal(t, []byte("a3"), next.field)
+}
+
+func TestHScanEmptyField(t *testing.T) {
+	key := []byte("hash-scan-empty-field")
+	setHashFields(t, key, [][]byte{[]byte(""), []byte("a")}, [][]byte{[]byte("1"), []byte("2")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	for match, expected := range map[string][][]byte{
+		"*":     {[]byte(""), []byte("a")},
+		"a*":    {[]byte("a")},
+		"?":     {[]byte("a")},
+		"[a-z]": {[]byte("a")},
+	} {
+		next, fs, _, err := hash.HScan(nil, []byte(match), 10)
+		assert.NoError(t, err)
+		assert.Nil(t, next)
+		assert.Equal(t, expected, fs, match)
+	}
+}
+
+func TestHStreamCancel(t *testing.T) {
+	key := []byte("hash-stream")
+	var fields, values [][]byte
+	for i := 0; i < 10; i++ {
+		fields = append(fields, []byte(fmt.Sprintf("f%d", i)))
+		values = append(values, []byte(fmt.Sprintf("v%d", i)))
+	}
+	setHashFields(t, key, fields, values)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	var iter *trackIter
+	txn.t = &faultTxn{Transaction: txn.t, seek: func(t store.Transaction, k kv.Key) (kv.Iterator, error) {
+		it, err := t.Seek(k)
+		if err != nil {
+			return nil, err
+		}
+		iter = &trackIter{Iterator: it}
+		return iter, nil
+	}}
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	fieldc, errc := hash.HStream(ctx)
+	for i := 0; i < 3; i++ {
+		f := <-fieldc
+		assert.Equal(t, fields[i], f.Field)
+		assert.Equal(t, values[i], f.Value)
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-errc)
+	for range fieldc {
+	}
+	assert.True(t, iter.closed)
+
+	fieldc, errc = hash.HStream(context.Background())
+	n := 0
+	for f := range fieldc {
+		assert.Equal(t, fields[n], f.Field)
+		n++
+	}
+	assert.NoError(t, <-errc)
+	assert.Equal(t, len(fields), n)
+	assert.True(t, iter.closed)
+}
+
+func TestBulkLoad(t *testing.T) {
+	key := []byte("hash-bulk-load")
+	var fields, values [][]byte
+	for i := 0; i < 100; i++ {
+		fields = append(fields, []byte(fmt.Sprintf("f%03d", i)))
+		values = append(values, []byte(fmt.Sprintf("v%03d", i)))
+	}
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrLengthMismatch, hash.BulkLoad(fields, values[1:], true))
+	assert.NoError(t, hash.BulkLoad(fields, values, true))
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(100), hash.HLen())
+	fs, vs, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+	assert.Equal(t, values, vs)
+
+	// loading into an existing hash falls back to HMSet
+	assert.NoError(t, hash.BulkLoad(fields[:10], values[:10], true))
+	assert.Equal(t, int64(100), hash.HLen())
+}
+
+func benchmarkLoad(b *testing.B, load func(hash *Hash, fields, values [][]byte) error) {
+	var fields, values [][]byte
+	for i := 0; i < 1000; i++ {
+		fields = append(fields, []byte(fmt.Sprintf("field-%04d", i)))
+		values = append(values, []byte(fmt.Sprintf("value-%04d", i)))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		txn, err := mockDB.Begin()
+		if err != nil {
+			b.Fatal(err)
+		}
+		hash, err := txn.Hash([]byte(fmt.Sprintf("hash-bench-load-%d", i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := load(hash, fields, values); err != nil {
+			b.Fatal(err)
+		}
+		txn.Rollback()
+	}
+}
+
+func BenchmarkBulkLoad(b *testing.B) {
+	benchmarkLoad(b, func(hash *Hash, fields, values [][]byte) error {
+		return hash.BulkLoad(fields, values, true)
+	})
+}
+
+func BenchmarkBulkLoadHMSet(b *testing.B) {
+	benchmarkLoad(b, func(hash *Hash, fields, values [][]byte) error {
+		return hash.HMSet(fields, values)
+	})
+}
+
+var benchmarkHashSizes = []int{10, 100, 1000}
+
+// benchmarkHash runs op against a hash of each size in benchmarkHashSizes held by a store.MemTxn, so the
+// store costs nothing. Every run of op gets a clone of the transaction holding the hash, only op is timed
+func benchmarkHash(b *testing.B, op func(hash *Hash, fields, values [][]byte, i int) error) {
+	for _, size := range benchmarkHashSizes {
+		b.Run(fmt.Sprintf("fields=%d", size), func(b *testing.B) {
+			var fields, values [][]byte
+			for i := 0; i < size; i++ {
+				fields = append(fields, []byte(fmt.Sprintf("field-%04d", i)))
+				values = append(values, []byte(fmt.Sprintf("value-%04d", i)))
+			}
+			key := []byte("hash-bench")
+			mem := store.NewMemTxn()
+			hash, err := (&Transaction{t: mem, db: mockDB}).Hash(key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := hash.HMSet(fields, values); err != nil {
+				b.Fatal(err)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				hash, err := (&Transaction{t: mem.Clone(), db: mockDB}).Hash(key)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.StartTimer()
+				if err := op(hash, fields, values, i); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkHSet(b *testing.B) {
+	benchmarkHash(b, func(hash *Hash, fields, values [][]byte, i int) error {
+		_, err := hash.HSet(fields[i%len(fields)], []byte("changed"))
+		return err
+	})
+}
+
+func BenchmarkHGet(b *testing.B) {
+	benchmarkHash(b, func(hash *Hash, fields, values [][]byte, i int) error {
+		_, err := hash.HGet(fields[i%len(fields)])
+		return err
+	})
+}
+
+func BenchmarkHMSet(b *testing.B) {
+	benchmarkHash(b, func(hash *Hash, fields, values [][]byte, i int) error {
+		n := 10
+		if n > len(fields) {
+			n = len(fields)
+		}
+		start := i % (len(fields) - n + 1)
+		return hash.HMSet(fields[start:start+n], values[:n])
+	})
+}
+
+func BenchmarkHGetAll(b *testing.B) {
+	benchmarkHash(b, func(hash *Hash, fields, values [][]byte, i int) error {
+		_, _, err := hash.HGetAll()
+		return err
+	})
+}
+
+func BenchmarkHDel(b *testing.B) {
+	benchmarkHash(b, func(hash *Hash, fields, values [][]byte, i int) error {
+		_, err := hash.HDel([][]byte{fields[i%len(fields)]})
+		return err
+	})
+}
+
+func TestHLenOrMissing(t *testing.T) {
+	key := []byte("hash-len-or-missing")
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	l, exists, err := hash.HLenOrMissing()
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, int64(-1), l)
+
+	// an empty hash is normally destroyed, write its meta directly
+	assert.NoError(t, hash.updateMeta())
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	l, exists, err = hash.HLenOrMissing()
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, int64(0), l)
+
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("f1"), []byte("f2")}, [][]byte{[]byte("v1"), []byte("v2")}))
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	l, exists, err = hash.HLenOrMissing()
+	assert.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, int64(2), l)
+
+	_, err = hash.HDel([][]byte{[]byte("f1"), []byte("f2")})
+	assert.NoError(t, err)
+	l, exists, err = hash.HLenOrMissing()
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, int64(-1), l)
+}
+
+func TestSnapshotReader(t *testing.T) {
+	key1 := []byte("hash-snapshot-1")
+	key2 := []byte("hash-snapshot-2")
+	setHashFields(t, key1, [][]byte{[]byte("f")}, [][]byte{[]byte("v1")})
+	setHashFields(t, key2, [][]byte{[]byte("f")}, [][]byte{[]byte("v1")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	reader := NewSnapshotReader(txn)
+	fs, vs, err := reader.ReadHashAll(key1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("f")}, fs)
+	assert.Equal(t, [][]byte{[]byte("v1")}, vs)
+
+	setHashFields(t, key2, [][]byte{[]byte("f"), []byte("g")}, [][]byte{[]byte("v2"), []byte("v2")})
+
+	fs, vs, err = reader.ReadHashAll(key2)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("f")}, fs)
+	assert.Equal(t, [][]byte{[]byte("v1")}, vs)
+
+	fs, vs, err = reader.ReadHashAll([]byte("hash-snapshot-missing"))
+	assert.NoError(t, err)
+	assert.Nil(t, fs)
+	assert.Nil(t, vs)
+}
+
+func TestHDelMatch(t *testing.T) {
+	key := []byte("hash-del-match")
+	fields := [][]byte{[]byte("session:1"), []byte("session:2"), []byte("user:1"), []byte("user:2"), []byte("xsession:3")}
+	values := [][]byte{[]byte("s1"), []byte("s2"), []byte("u1"), []byte("u2"), []byte("x3")}
+	setHashFields(t, key, fields, values)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	deleted, l, err := hash.HDelMatch("*session:*", true)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("session:1"), []byte("session:2"), []byte("xsession:3")}, deleted)
+	assert.Equal(t, int64(3), l)
+	deleted, l, err = hash.HDelMatch("session:*", true)
+	assert.NoError(t, err)
+	assert.Equal(t, fields[:2], deleted)
+	assert.Equal(t, int64(2), l)
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), hash.HLen())
+	fs, _, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+
+	deleted, l, err = hash.HDelMatch("session:*", false)
+	assert.NoError(t, err)
+	assert.Equal(t, fields[:2], deleted)
+	assert.Equal(t, int64(2), l)
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), hash.HLen())
+	fs, _, err = hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, fields[2:], fs)
+}
+
+func TestHDelMatchEmptyField(t *testing.T) {
+	key := []byte("hash-del-match-empty-field")
+	setHashFields(t, key, [][]byte{[]byte(""), []byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2"), []byte("3")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	deleted, l, err := hash.HDelMatch("?", false)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, deleted)
+	assert.Equal(t, int64(2), l)
+	fs, _, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("")}, fs)
+}
+
+func TestHGetAllOrder(t *testing.T) {
+	fields := [][]byte{[]byte("\xffz"), []byte("a"), []byte("\x80"), []byte("Z"), []byte("\xc3\xa9"), []byte("\x00"), []byte("aa")}
+	values := make([][]byte, len(fields))
+	for i := range fields {
+		values[i] = []byte(fmt.Sprintf("v%d", i))
+	}
+	reversedFields := make([][]byte, len(fields))
+	reversedValues := make([][]byte, len(fields))
+	for i := range fields {
+		reversedFields[len(fields)-1-i] = fields[i]
+		reversedValues[len(fields)-1-i] = values[i]
+	}
+	setHashFields(t, []byte("hash-order-1"), fields, values)
+	setHashFields(t, []byte("hash-order-2"), reversedFields, reversedValues)
+
+	want := make([][]byte, len(fields))
+	copy(want, fields)
+	sort.Slice(want, func(i, j int) bool { return bytes.Compare(want[i], want[j]) < 0 })
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	for _, key := range []string{"hash-order-1", "hash-order-2"} {
+		hash, err := txn.Hash([]byte(key))
+		assert.NoError(t, err)
+		fs, _, err := hash.HGetAll()
+		assert.NoError(t, err)
+		assert.Equal(t, want, fs)
+	}
+}
+
+func TestIsValidField(t *testing.T) {
+	for _, f := range []string{"", "field", "user.1", "\x00\xff"} {
+		assert.True(t, IsValidField([]byte(f)), f)
+	}
+	for _, f := range []string{":", "user:1", "field:", ":field"} {
+		assert.False(t, IsValidField([]byte(f)), f)
+	}
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-strict-fields"))
+	assert.NoError(t, err)
+	_, err = hash.HSet([]byte("user:1"), []byte("v"))
+	assert.NoError(t, err)
+
+	SetStrictFields(true)
+	defer SetStrictFields(false)
+	_, err = hash.HSet([]byte("user:2"), []byte("v"))
+	assert.Equal(t, ErrInvalidField, err)
+	assert.Equal(t, ErrInvalidField, hash.HMSet([][]byte{[]byte("ok"), []byte("user:3")}, [][]byte{[]byte("v"), []byte("v")}))
+	fields, _, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("user:1")}, fields)
+}
+
+func TestHGetAllInsertionOrder(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+
+	hash, err := txn.Hash([]byte("hash-insertion-order"))
+	assert.NoError(t, err)
+	_, _, err = hash.HGetAllInsertionOrder()
+	assert.Equal(t, ErrInsertionOrderDisabled, err)
+	assert.Equal(t, ErrKeyNotFound, hash.EnableInsertionOrder())
+	_, err = hash.HSet([]byte("c"), []byte("vc"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.EnableInsertionOrder())
+	for _, f := range []string{"c", "a", "b"} {
+		_, err := hash.HSet([]byte(f), []byte("v"+f))
+		assert.NoError(t, err)
+	}
+	_, err = hash.HSet([]byte("c"), []byte("vc"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("e"), []byte("d")}, [][]byte{[]byte("ve"), []byte("vd")}))
+	_, err = hash.HDel([][]byte{[]byte("a")})
+	assert.NoError(t, err)
+	_, err = hash.HIncrBy([]byte("a"), 1)
+	assert.NoError(t, err)
+
+	hash, err = txn.Hash([]byte("hash-insertion-order"))
+	assert.NoError(t, err)
+	fs, vs, err := hash.HGetAllInsertionOrder()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("c"), []byte("b"), []byte("e"), []byte("d"), []byte("a")}, fs)
+	assert.Equal(t, [][]byte{[]byte("vc"), []byte("vb"), []byte("ve"), []byte("vd"), []byte("1")}, vs)
+	fs, _, err = hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}, fs)
+
+	// existing fields are indexed in key order
+	hash, err = txn.Hash([]byte("hash-insertion-order-existing"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("y"), []byte("x")}, [][]byte{[]byte("vy"), []byte("vx")}))
+	assert.NoError(t, hash.EnableInsertionOrder())
+	_, err = hash.HSet([]byte("w"), []byte("vw"))
+	assert.NoError(t, err)
+	fs, _, err = hash.HGetAllInsertionOrder()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("x"), []byte("y"), []byte("w")}, fs)
+}
+
+func TestHIncrByWithDefault(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-incr-default"))
+	assert.NoError(t, err)
+
+	n, err := hash.HIncrByWithDefault([]byte("counter"), 5, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(105), n)
+	assert.Equal(t, int64(1), hash.HLen())
+
+	n, err = hash.HIncrByWithDefault([]byte("counter"), 5, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(110), n)
+	assert.Equal(t, int64(1), hash.HLen())
+
+	n, err = hash.HIncrBy([]byte("other"), -3)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(-3), n)
+	v, err := hash.HGet([]byte("counter"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("110"), v)
+
+	// an overflow leaves the field as it was
+	isOverflow := func(err error) bool {
+		fe, ok := err.(*FieldError)
+		return ok && fe.Err == ErrInteger
+	}
+	n, err = hash.HIncrByWithDefault([]byte("max"), 0, math.MaxInt64)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(math.MaxInt64), n)
+	_, err = hash.HIncrBy([]byte("max"), 1)
+	assert.True(t, isOverflow(err))
+	_, err = hash.HIncrByWithDefault([]byte("min"), -1, math.MinInt64)
+	assert.True(t, isOverflow(err))
+	v, err = hash.HGet([]byte("max"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(strconv.FormatInt(math.MaxInt64, 10)), v)
+	v, err = hash.HGet([]byte("min"))
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+}
+
+// sizeLimiter rejects data values larger than max bytes
+type sizeLimiter struct {
+	max    int
+	writes int
+}
+
+func (l *sizeLimiter) BeforeWrite(op WriteOp, key, value []byte) error {
+	if bytes.HasPrefix(key, DataKey(mockDB, nil)) && len(value) > l.max {
+		return errors.New("value too large")
+	}
+	l.writes++
+	return nil
+}
+
+func TestWriteInterceptor(t *testing.T) {
+	key := []byte("hash-interceptor")
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	limiter := &sizeLimiter{max: 8}
+	txn.SetWriteInterceptor(limiter)
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	_, err = hash.HSet([]byte("small"), []byte("v"))
+	assert.NoError(t, err)
+	// the item and the meta
+	assert.Equal(t, 2, limiter.writes)
+
+	_, err = hash.HSet([]byte("large"), []byte("a value over the limit"))
+	assert.EqualError(t, err, "value too large")
+	assert.Equal(t, 2, limiter.writes)
+
+	txn.SetWriteInterceptor(nil)
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), hash.HLen())
+	v, err := hash.HGet([]byte("large"))
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+}
+
+func TestHGetTyped(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-get-typed"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("good"), []byte("bad")}, [][]byte{[]byte(`{"a":1}`), []byte(`{"a":`)}))
+
+	validJSON := func(v []byte) error {
+		var doc interface{}
+		return json.Unmarshal(v, &doc)
+	}
+	v, err := hash.HGetTyped([]byte("good"), validJSON)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte(`{"a":1}`), v)
+
+	v, err = hash.HGetTyped([]byte("bad"), validJSON)
+	assert.Nil(t, v)
+	ferr, ok := err.(*FieldError)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("bad"), ferr.Field)
+	assert.Error(t, ferr.Err)
+	assert.Contains(t, err.Error(), `"bad"`)
+
+	v, err = hash.HGetTyped([]byte("missing"), validJSON)
+	assert.NoError(t, err)
+	assert.Nil(t, v)
+}
+
+func TestHashItemKeyNoAliasing(t *testing.T) {
+	dkey := make([]byte, 0, 1024)
+	dkey = append(dkey, DataKey(mockDB, UUID())...)
+	prefix := hashItemKey(dkey, nil)
+	keys := make([][]byte, 1000)
+	for i := range keys {
+		keys[i] = hashItemKey(dkey, []byte(strconv.Itoa(i)))
+	}
+	seen := make(map[string]bool)
+	for i, key := range keys {
+		assert.False(t, seen[string(key)])
+		seen[string(key)] = true
+		assert.True(t, bytes.HasPrefix(key, prefix))
+		n, err := strconv.Atoi(string(key[len(prefix):]))
+		assert.NoError(t, err)
+		assert.Equal(t, i, n)
+	}
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-del-many"))
+	assert.NoError(t, err)
+	fields := [][]byte{[]byte("f1"), []byte("f2"), []byte("f3")}
+	assert.NoError(t, hash.HMSet(fields, fields))
+	n, err := hash.HDel(fields[:2])
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	fs, _, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, fields[2:], fs)
+}
+
+func TestHGetAllLazy(t *testing.T) {
+	key := []byte("hgetall-lazy")
+	fields := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	values := [][]byte{[]byte("va"), bytes.Repeat([]byte("vb"), 1024), []byte("vc")}
+	setHashFields(t, key, fields, values)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	var gets []string
+	txn.t = &faultTxn{Transaction: txn.t, get: func(t store.Transaction, k kv.Key) ([]byte, error) {
+		gets = append(gets, string(k))
+		return t.Get(k)
+	}}
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	gets = nil
+
+	fs, getters, err := hash.HGetAllLazy()
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+	assert.Len(t, getters, len(fields))
+	assert.Empty(t, gets)
+
+	val, err := getters[1]()
+	assert.NoError(t, err)
+	assert.Equal(t, values[1], val)
+	dkey := DataKey(mockDB, hash.meta.ID)
+	assert.Equal(t, []string{string(hashItemKey(dkey, fields[1]))}, gets)
+
+	// the values are not decoded by the scan, only a getter meets a corrupted one
+	assert.NoError(t, hash.EnableCompression())
+	assert.NoError(t, txn.t.Set(hashItemKey(dkey, fields[2]), []byte{hashValueSnappy, 0xff}))
+	_, _, err = hash.HGetAll()
+	assert.Equal(t, ErrCorruptedValue, err)
+	fs, getters, err = hash.HGetAllLazy()
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+	_, err = getters[2]()
+	assert.Equal(t, ErrCorruptedValue, err)
+}
+
+func TestHSwap(t *testing.T) {
+	key := []byte("hswap")
+	setHashFields(t, key, [][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("va"), []byte("vb")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, hash.HSwap([]byte("a"), []byte("b")))
+	fs, vs, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, fs)
+	assert.Equal(t, [][]byte{[]byte("vb"), []byte("va")}, vs)
+	assert.Equal(t, int64(2), hash.meta.Len)
+
+	// swapping with a missing field moves the value
+	assert.NoError(t, hash.HSwap([]byte("a"), []byte("c")))
+	fs, vs, err = hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, fs)
+	assert.Equal(t, [][]byte{[]byte("va"), []byte("vb")}, vs)
+	assert.Equal(t, int64(2), hash.meta.Len)
+
+	assert.NoError(t, hash.HSwap([]byte("x"), []byte("y")))
+	assert.Equal(t, int64(2), hash.meta.Len)
+
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), hash.meta.Len)
+}
+
+func TestHMerge(t *testing.T) {
+	key := []byte("hmerge")
+	setHashFields(t, key, [][]byte{[]byte("n")}, [][]byte{[]byte("1")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	incr := func(old []byte) ([]byte, error) {
+		n := 0
+		if old != nil {
+			var err error
+			if n, err = strconv.Atoi(string(old)); err != nil {
+				return nil, err
+			}
+		}
+		return []byte(strconv.Itoa(n + 1)), nil
+	}
+
+	// merging into an existing field
+	val, err := hash.HMerge([]byte("n"), incr)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), val)
+	assert.Equal(t, int64(1), hash.meta.Len)
+
+	// merging into a new field
+	val, err = hash.HMerge([]byte("m"), func(old []byte) ([]byte, error) {
+		assert.Nil(t, old)
+		return incr(old)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), val)
+	assert.Equal(t, int64(2), hash.meta.Len)
+
+	// a failed merge writes nothing
+	bad := errors.New("bad merge")
+	_, err = hash.HMerge([]byte("n"), func(old []byte) ([]byte, error) { return nil, bad })
+	fe, ok := err.(*FieldError)
+	assert.True(t, ok)
+	assert.Equal(t, bad, fe.Err)
+	_, err = hash.HMerge([]byte("x"), func(old []byte) ([]byte, error) { return nil, bad })
+	assert.Error(t, err)
+
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), hash.meta.Len)
+	fs, vs, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("m"), []byte("n")}, fs)
+	assert.Equal(t, [][]byte{[]byte("1"), []byte("2")}, vs)
+
+	// an empty result deletes the field like a nil one
+	empty := func(old []byte) ([]byte, error) { return []byte{}, nil }
+	val, err = hash.HMerge([]byte("m"), empty)
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	val, err = hash.HMerge([]byte("x"), empty)
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	assert.Equal(t, int64(1), hash.meta.Len)
+	fs, _, err = hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("n")}, fs)
+
+	// deleting the only field destroys the hash
+	val, err = hash.HMerge([]byte("n"), empty)
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	_, exists, err := hash.HLenOrMissing()
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestHashUniqueValues(t *testing.T) {
+	key := []byte("hash-unique-values")
+	setHashFields(t, key, [][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("x"), []byte("x")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	isDuplicate := func(err error) bool {
+		fe, ok := err.(*FieldError)
+		return ok && fe.Err == ErrDuplicateValue
+	}
+	assert.True(t, isDuplicate(hash.EnableUniqueValues()))
+	_, err = hash.HSet([]byte("b"), []byte("y"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.EnableUniqueValues())
+
+	// two fields can not hold the same value
+	_, err = hash.HSet([]byte("c"), []byte("x"))
+	assert.True(t, isDuplicate(err))
+	assert.True(t, isDuplicate(hash.HMSet([][]byte{[]byte("c"), []byte("d")}, [][]byte{[]byte("z"), []byte("z")})))
+	_, err = hash.HIncrBy([]byte("c"), 1)
+	assert.NoError(t, err)
+	_, err = hash.HIncrBy([]byte("d"), 1)
+	assert.True(t, isDuplicate(err))
+	_, err = hash.HSet([]byte("a"), []byte("x"))
+	assert.NoError(t, err)
+
+	// values moved between fields of one call are released first
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("y"), []byte("x")}))
+	assert.NoError(t, hash.HSwap([]byte("a"), []byte("b")))
+	val, err := hash.HGet([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("x"), val)
+
+	// deleting the field frees its value
+	_, err = hash.HDel([][]byte{[]byte("a")})
+	assert.NoError(t, err)
+	_, err = hash.HSet([]byte("c"), []byte("x"))
+	assert.NoError(t, err)
+	_, err = hash.HSet([]byte("d"), []byte("x"))
+	assert.True(t, isDuplicate(err))
+	assert.Empty(t, hash.SelfCheck())
+
+	// enabling on a missing key creates nothing
+	missing, err := txn.Hash([]byte("hash-unique-values-missing"))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrKeyNotFound, missing.EnableUniqueValues())
+	_, exists, err := missing.HLenOrMissing()
+	assert.NoError(t, err)
+	assert.False(t, exists)
+}
+
+func TestHSetCond(t *testing.T) {
+	key := []byte("hsetcond")
+	cases := []struct {
+		mode    SetMode
+		present bool
+		written bool
+	}{
+		{SetModeAlways, false, true},
+		{SetModeAlways, true, true},
+		{SetModeNX, false, true},
+		{SetModeNX, true, false},
+		{SetModeXX, false, false},
+		{SetModeXX, true, true},
+	}
+	for _, c := range cases {
+		txn, err := mockDB.Begin()
+		assert.NoError(t, err)
+		hash, err := txn.Hash(key)
+		assert.NoError(t, err)
+		assert.NoError(t, hash.HMSet([][]byte{[]byte("other")}, [][]byte{[]byte("x")}))
+		if c.present {
+			_, err = hash.HSet([]byte("f"), []byte("old"))
+			assert.NoError(t, err)
+		}
+
+		written, err := hash.HSetCond([]byte("f"), []byte("new"), c.mode)
+		assert.NoError(t, err)
+		assert.Equal(t, c.written, written, "%v %v", c.mode, c.present)
+		want, wantLen := []byte(nil), int64(1)
+		if c.present {
+			want, wantLen = []byte("old"), 2
+		}
+		if c.written {
+			want, wantLen = []byte("new"), 2
+		}
+		hash, err = txn.Hash(key)
+		assert.NoError(t, err)
+		val, err := hash.HGet([]byte("f"))
+		assert.NoError(t, err)
+		assert.Equal(t, want, val, "%v %v", c.mode, c.present)
+		assert.Equal(t, wantLen, hash.HLen(), "%v %v", c.mode, c.present)
+		assert.NoError(t, txn.Rollback())
+	}
+}
+
+func TestHSetNX(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hsetnx"))
+	assert.NoError(t, err)
+
+	n, err := hash.HSetNX([]byte("f"), []byte("v1"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = hash.HSetNX([]byte("f"), []byte("v2"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	hash, err = txn.Hash([]byte("hsetnx"))
+	assert.NoError(t, err)
+	val, err := hash.HGet([]byte("f"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("v1"), val)
+	assert.Equal(t, int64(1), hash.HLen())
+	assert.Empty(t, hash.SelfCheck())
+}
+
+func TestHAppend(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("happend"))
+	assert.NoError(t, err)
+
+	n, err := hash.HAppend([]byte("log"), []byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.Equal(t, int64(1), hash.meta.Len)
+	n, err = hash.HAppend([]byte("log"), []byte("bc"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, int64(1), hash.meta.Len)
+
+	n, err = hash.HAppend([]byte("log"), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	n, err = hash.HAppend([]byte("missing"), []byte{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	assert.Equal(t, int64(1), hash.meta.Len)
+
+	hash, err = txn.Hash([]byte("happend"))
+	assert.NoError(t, err)
+	val, err := hash.HGet([]byte("log"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abc"), val)
+	assert.Equal(t, int64(1), hash.HLen())
+}
+
+func TestHSetRange(t *testing.T) {
+	key := []byte("hsetrange")
+	setHashFields(t, key, [][]byte{[]byte("f")}, [][]byte{[]byte("hello world")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	get := func(field string) []byte {
+		val, err := hash.HGet([]byte(field))
+		assert.NoError(t, err)
+		return val
+	}
+
+	// overwriting within the value
+	n, err := hash.HSetRange([]byte("f"), 6, []byte("titan"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(11), n)
+	assert.Equal(t, []byte("hello titan"), get("f"))
+
+	// extending beyond the value pads it with zeros
+	n, err = hash.HSetRange([]byte("f"), 13, []byte("!"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(14), n)
+	assert.Equal(t, []byte("hello titan\x00\x00!"), get("f"))
+	assert.Equal(t, int64(1), hash.meta.Len)
+
+	// creating a new field
+	n, err = hash.HSetRange([]byte("g"), 2, []byte("ab"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), n)
+	assert.Equal(t, []byte("\x00\x00ab"), get("g"))
+	assert.Equal(t, int64(2), hash.meta.Len)
+
+	n, err = hash.HSetRange([]byte("h"), 5, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	assert.Nil(t, get("h"))
+	_, err = hash.HSetRange([]byte("f"), -1, []byte("x"))
+	assert.Equal(t, ErrOutOfRange, err)
+	_, err = hash.HSetRange([]byte("f"), hsetRangeMaxSize, []byte("x"))
+	assert.Equal(t, ErrValueTooLarge, err)
+	// the end of the range must not wrap around
+	_, err = hash.HSetRange([]byte("f"), math.MaxInt64, []byte("x"))
+	assert.Equal(t, ErrValueTooLarge, err)
+
+	SetMaxValueSize(16)
+	defer SetMaxValueSize(0)
+	_, err = hash.HSetRange([]byte("f"), 1<<40, []byte("x"))
+	assert.Equal(t, ErrValueTooLarge, err)
+}
+
+func TestHGetRange(t *testing.T) {
+	key := []byte("hgetrange")
+	setHashFields(t, key, [][]byte{[]byte("f")}, [][]byte{[]byte("0123456789")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	cases := []struct {
+		start, end int64
+		want       string
+	}{
+		{0, 3, "0123"},
+		{2, 2, "2"},
+		{-3, -1, "789"},
+		{0, -1, "0123456789"},
+		{-100, 1, "01"},
+		{5, 100, "56789"},
+		{10, 20, ""},
+		{4, 2, ""},
+		{-1, -3, ""},
+	}
+	for _, c := range cases {
+		val, err := hash.HGetRange([]byte("f"), c.start, c.end)
+		assert.NoError(t, err)
+		assert.Equal(t, []byte(c.want), val, "%d %d", c.start, c.end)
+	}
+	val, err := hash.HGetRange([]byte("missing"), 0, -1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, val)
+}
+
+func TestHIncrByMany(t *testing.T) {
+	key := []byte("hincrby-many")
+	setHashFields(t, key, [][]byte{[]byte("a"), []byte("max"), []byte("s")}, [][]byte{[]byte("10"), []byte(strconv.FormatInt(math.MaxInt64, 10)), []byte("x")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	_, err = hash.HIncrByMany([][]byte{[]byte("a")}, nil)
+	assert.Equal(t, ErrLengthMismatch, err)
+
+	// existing and new fields, a repeated field counts every delta
+	nums, err := hash.HIncrByMany([][]byte{[]byte("a"), []byte("b"), []byte("a")}, []int64{5, -2, 1})
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{15, -2, 16}, nums)
+	assert.Equal(t, int64(4), hash.meta.Len)
+
+	// an overflow or a non-integer writes nothing
+	_, err = hash.HIncrByMany([][]byte{[]byte("a"), []byte("max")}, []int64{1, 1})
+	assert.Equal(t, &FieldError{Field: []byte("max"), Err: ErrInteger}, err)
+	_, err = hash.HIncrByMany([][]byte{[]byte("b"), []byte("b")}, []int64{math.MinInt64 + 2, -1})
+	assert.Equal(t, &FieldError{Field: []byte("b"), Err: ErrInteger}, err)
+	_, err = hash.HIncrByMany([][]byte{[]byte("a"), []byte("s")}, []int64{1, 1})
+	assert.Equal(t, &FieldError{Field: []byte("s"), Err: ErrNotAnInteger}, err)
+
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), hash.HLen())
+	vals, err := hash.HMGet([][]byte{[]byte("a"), []byte("b")})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("16"), []byte("-2")}, vals)
+}
+
+func TestHashCompression(t *testing.T) {
+	key := []byte("hash-compression")
+	small := []byte("small")
+	large := bytes.Repeat([]byte(`{"name":"titan","kind":"hash"}`), 100)
+	setHashFields(t, key, [][]byte{[]byte("old")}, [][]byte{large})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	missing, err := txn.Hash([]byte("hash-compression-missing"))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrKeyNotFound, missing.EnableCompression())
+	assert.NoError(t, hash.EnableCompression())
+	_, err = hash.HSet([]byte("large"), large)
+	assert.NoError(t, err)
+	_, err = hash.HSet([]byte("small"), small)
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	dkey := DataKey(mockDB, hash.meta.ID)
+	for _, field := range []string{"old", "large"} {
+		raw, err := txn.t.Get(hashItemKey(dkey, []byte(field)))
+		assert.NoError(t, err)
+		assert.True(t, len(raw) < len(large))
+		val, err := hash.HGet([]byte(field))
+		assert.NoError(t, err)
+		assert.Equal(t, large, val)
+	}
+	raw, err := txn.t.Get(hashItemKey(dkey, small))
+	assert.NoError(t, err)
+	assert.Equal(t, append([]byte{hashValueRaw}, small...), raw)
+
+	fs, vs, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("large"), []byte("old"), small}, fs)
+	assert.Equal(t, [][]byte{large, large, small}, vs)
+
+	n, err := hash.HIncrBy([]byte("counter"), 2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	n, err = hash.HIncrBy([]byte("counter"), 3)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(5), n)
+}
+
+func TestHGetAllJSON(t *testing.T) {
+	key := []byte("hgetall-json")
+	fields := [][]byte{[]byte("bin"), []byte("text"), []byte("中文")}
+	values := [][]byte{{0xff, 0x00, 0xfe}, []byte(`say "hi" <b>`), []byte("值")}
+	setHashFields(t, key, fields, values)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	data, err := hash.HGetAllJSON()
+	assert.NoError(t, err)
+	assert.True(t, json.Valid(data))
+	var obj map[string]interface{}
+	assert.NoError(t, json.Unmarshal(data, &obj))
+	assert.Equal(t, `say "hi" <b>`, obj["text"])
+	assert.Equal(t, map[string]interface{}{"base64": "/wD+"}, obj["bin"])
+
+	fs, vs, err := ParseHashJSON(data)
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+	assert.Equal(t, values, vs)
+
+	_, err = hash.HSet([]byte{0xff}, []byte("v"))
+	assert.NoError(t, err)
+	_, err = hash.HGetAllJSON()
+	assert.Equal(t, &FieldError{Field: []byte{0xff}, Err: ErrInvalidUTF8}, err)
+
+	empty, err := txn.Hash([]byte("hgetall-json-empty"))
+	assert.NoError(t, err)
+	data, err = empty.HGetAllJSON()
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", string(data))
+}
+
+func TestHGetAllJSONPath(t *testing.T) {
+	key := []byte("hgetall-json-path")
+	fields := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	values := [][]byte{
+		[]byte(`{"name": "alice", "tags": ["x", {"k": 1}]}`),
+		[]byte(`{"age": 3}`),
+		[]byte("not json"),
+		[]byte(`["name"]`),
+	}
+	setHashFields(t, key, fields, values)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	fs, extracted, err := hash.HGetAllJSONPath("$.name")
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+	assert.Equal(t, [][]byte{[]byte(`"alice"`), nil, nil, nil}, extracted)
+
+	_, extracted, err = hash.HGetAllJSONPath("$.tags[1].k")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("1"), nil, nil, nil}, extracted)
+	_, extracted, err = hash.HGetAllJSONPath("$[0]")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{nil, nil, nil, []byte(`"name"`)}, extracted)
+	_, extracted, err = hash.HGetAllJSONPath("$")
+	assert.NoError(t, err)
+	assert.Equal(t, values[1], extracted[1])
+	assert.Nil(t, extracted[2])
+
+	for _, path := range []string{"", "name", "$.", "$[x]", "$[-1]", "$[0", "$name"} {
+		_, _, err = hash.HGetAllJSONPath(path)
+		assert.Equal(t, ErrInvalidJSONPath, err, path)
+	}
+}
+
+func TestHashValidate(t *testing.T) {
+	key := []byte("hash-validate")
+	setHashFields(t, key, [][]byte{[]byte("f")}, [][]byte{[]byte("v")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	assert.NoError(t, hash.Validate())
+
+	hash.meta.Encoding = ObjectEncodingRaw
+	assert.NoError(t, hash.updateMeta())
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrEncodingMismatch, hash.Validate())
+}
+
+func TestHMSetPartialFailure(t *testing.T) {
+	key := []byte("hmset-partial-failure")
+	setHashFields(t, key, [][]byte{[]byte("f1")}, [][]byte{[]byte("old")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	sets := 0
+	txn.t = &faultTxn{Transaction: txn.t, set: func(t store.Transaction, k kv.Key, v []byte) error {
+		sets++
+		if sets == 3 {
+			return errInjected
+		}
+		return t.Set(k, v)
+	}}
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	fields := [][]byte{[]byte("f0"), []byte("f1"), []byte("f2"), []byte("f3"), []byte("f4")}
+	err = hash.HMSet(fields, fields)
+	assert.Equal(t, errInjected, err)
+	assert.Equal(t, int64(1), hash.meta.Len)
+
+	vals, err := hash.HMGet(fields)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{nil, []byte("old"), nil, nil, nil}, vals)
+
+	// a failed restore is returned along with the error which triggered it
+	errRestore := errors.New("restore failed")
+	sets = 0
+	txn.t = &faultTxn{Transaction: txn.t.(*faultTxn).Transaction, set: func(t store.Transaction, k kv.Key, v []byte) error {
+		sets++
+		switch sets {
+		case 3:
+			return errInjected
+		case 4:
+			return errRestore
+		}
+		return t.Set(k, v)
+	}}
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, &RestoreError{Err: errInjected, RestoreErr: errRestore}, hash.HMSet(fields, fields))
+}
+
+// vetoLimiter vetoes the nth write it sees
+type vetoLimiter struct {
+	n      int
+	writes int
+}
+
+func (l *vetoLimiter) BeforeWrite(op WriteOp, key, value []byte) error {
+	l.writes++
+	if l.writes == l.n {
+		return errInjected
+	}
+	return nil
+}
+
+func TestHMSetStaged(t *testing.T) {
+	key := []byte("hmset-staged")
+	setHashFields(t, key, [][]byte{[]byte("f1")}, [][]byte{[]byte("old")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	sets := 0
+	txn.t = &faultTxn{Transaction: txn.t, set: func(t store.Transaction, k kv.Key, v []byte) error {
+		sets++
+		return t.Set(k, v)
+	}}
+	txn.SetWriteInterceptor(&vetoLimiter{n: 3})
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	// fields and values of different lengths are refused before anything is written
+	fields := [][]byte{[]byte("f0"), []byte("f1"), []byte("f2"), []byte("f3")}
+	assert.Equal(t, ErrLengthMismatch, hash.HMSet(fields, fields[:3]))
+	assert.Equal(t, ErrLengthMismatch, hash.HMSet(fields[:3], fields))
+	assert.Equal(t, ErrLengthMismatch, hash.HMSet(nil, fields))
+	assert.Equal(t, 0, sets)
+
+	// the veto of the third field comes before any field reaches the store
+	assert.Equal(t, errInjected, hash.HMSet(fields, fields))
+	assert.Equal(t, 0, sets)
+	assert.Equal(t, int64(0), txn.WrittenKeys())
+
+	txn.SetWriteInterceptor(nil)
+	vals, err := hash.HMGet(fields)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{nil, []byte("old"), nil, nil}, vals)
+}
+
+func TestHVersion(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hversion"))
+	assert.NoError(t, err)
+	_, err = hash.HVersion([]byte("f"))
+	assert.Equal(t, ErrVersioningDisabled, err)
+
+	assert.Equal(t, ErrKeyNotFound, hash.EnableVersioning())
+	_, err = hash.HSet([]byte("e"), []byte("v"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.EnableVersioning())
+	version := func(field string) int64 {
+		ver, err := hash.HVersion([]byte(field))
+		assert.NoError(t, err)
+		return ver
+	}
+	assert.Equal(t, int64(0), version("f"))
+
+	_, err = hash.HSet([]byte("f"), []byte("v1"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), version("f"))
+	_, err = hash.HSet([]byte("f"), []byte("v2"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), version("f"))
+
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("f"), []byte("g")}, [][]byte{[]byte("v3"), []byte("v1")}))
+	_, err = hash.HIncrBy([]byte("n"), 1)
+	assert.NoError(t, err)
+	_, err = hash.HIncrBy([]byte("n"), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), version("f"))
+	assert.Equal(t, int64(1), version("g"))
+	assert.Equal(t, int64(2), version("n"))
+
+	// reads leave the versions alone
+	_, err = hash.HGet([]byte("f"))
+	assert.NoError(t, err)
+	_, _, err = hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), version("f"))
+
+	_, err = hash.HDel([][]byte{[]byte("g")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), version("g"))
+}
+
+func TestHScanSkipsSubKeys(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hscan-sub-keys"))
+	assert.NoError(t, err)
+	fields := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	assert.NoError(t, hash.HMSet(fields, fields))
+	assert.NoError(t, hash.EnableInsertionOrder())
+	assert.NoError(t, hash.EnableVersioning())
+
+	// the sub keys share the data key prefix with the fields
+	dkey := DataKey(mockDB, hash.meta.ID)
+	iter, err := txn.t.Seek(dkey)
+	assert.NoError(t, err)
+	var all int
+	for iter.Valid() && iter.Key().HasPrefix(dkey) {
+		all++
+		assert.NoError(t, iter.Next())
+	}
+	iter.Close()
+	assert.True(t, all > len(fields))
+
+	for _, match := range [][]byte{nil, []byte("*"), []byte("[a-c]")} {
+		next, fs, vs, err := hash.HScan(nil, match, 100)
+		assert.NoError(t, err)
+		assert.Nil(t, next)
+		assert.Equal(t, fields, fs)
+		assert.Equal(t, fields, vs)
+	}
+	fs, _, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+}
+
+func TestHLenNoIO(t *testing.T) {
+	key := []byte("hlen-no-io")
+	setHashFields(t, key, [][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	var calls int
+	txn.t = &faultTxn{Transaction: txn.t,
+		get: func(t store.Transaction, k kv.Key) ([]byte, error) {
+			calls++
+			return t.Get(k)
+		},
+		seek: func(t store.Transaction, k kv.Key) (kv.Iterator, error) {
+			calls++
+			return t.Seek(k)
+		},
+	}
+	assert.Equal(t, int64(2), hash.HLen())
+	assert.Equal(t, 0, calls)
+
+	// the cached count skips the verification of read repair
+	SetReadRepair(0)
+	defer SetReadRepair(-1)
+	hash.meta.Len = 5
+	assert.Equal(t, int64(5), hash.CachedLen())
+	assert.Equal(t, 0, calls)
+}
+
+func TestFreezeThaw(t *testing.T) {
+	key := []byte("hash-freeze")
+	fields := [][]byte{[]byte("a"), []byte("b"), {0x00, 0xff}}
+	values := [][]byte{[]byte("1"), bytes.Repeat([]byte("x"), 300), []byte("binary")}
+	setHashFields(t, key, fields, values)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	assert.NoError(t, hash.Freeze([]byte("hash-frozen")))
+
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Nil(t, hash.rawMeta)
+	str, err := txn.String([]byte("hash-frozen"))
+	assert.NoError(t, err)
+	assert.True(t, str.Exist())
+
+	assert.NoError(t, Thaw(txn, []byte("hash-frozen"), []byte("hash-thawed")))
+	str, err = txn.String([]byte("hash-frozen"))
+	assert.NoError(t, err)
+	assert.False(t, str.Exist())
+	hash, err = txn.Hash([]byte("hash-thawed"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), hash.HLen())
+	fs, vs, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{{0x00, 0xff}, []byte("a"), []byte("b")}, fs)
+	assert.Equal(t, [][]byte{[]byte("binary"), []byte("1"), values[1]}, vs)
+
+	// in place
+	assert.NoError(t, hash.Freeze([]byte("hash-thawed")))
+	assert.NoError(t, Thaw(txn, []byte("hash-thawed"), []byte("hash-thawed")))
+	hash, err = txn.Hash([]byte("hash-thawed"))
+	assert.NoError(t, err)
+	fs2, vs2, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, fs, fs2)
+	assert.Equal(t, vs, vs2)
+
+	// a missing hash is not frozen into an empty string
+	missing, err := txn.Hash([]byte("hash-freeze-missing"))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrKeyNotFound, missing.Freeze([]byte("hash-freeze-missing-dst")))
+	str, err = txn.String([]byte("hash-freeze-missing-dst"))
+	assert.NoError(t, err)
+	assert.False(t, str.Exist())
+
+	_, _, err = decodeHashBlob([]byte{hashBlobVersion, 1, 5, 'a'})
+	assert.Equal(t, ErrCorruptedValue, err)
+}
+
+func TestHashCreatedTime(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-created-time"))
+	assert.NoError(t, err)
+	created := hash.CreatedTime()
+	assert.WithinDuration(t, time.Now(), created, time.Second)
+	assert.Equal(t, hash.meta.CreatedAt, created.UnixNano())
+}
+
+func TestHDelEx(t *testing.T) {
+	key := []byte("hdel-ex")
+	setHashFields(t, key, [][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	n, destroyed, err := hash.HDelEx([][]byte{[]byte("a"), []byte("x")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.False(t, destroyed)
+
+	n, destroyed, err = hash.HDelEx([][]byte{[]byte("b")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.True(t, destroyed)
+	_, err = txn.t.Get(MetaKey(mockDB, key))
+	assert.True(t, IsErrNotFound(err))
+}
+
+func TestHDelRepeatedField(t *testing.T) {
+	key := []byte("hdel-repeated-field")
+	setHashFields(t, key, [][]byte{[]byte("f"), []byte("g")}, [][]byte{[]byte("1"), []byte("2")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	n, destroyed, err := hash.HDelEx([][]byte{[]byte("f"), []byte("f")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+	assert.False(t, destroyed)
+	assert.Equal(t, int64(1), hash.HLen())
+	assert.Empty(t, hash.SelfCheck())
+
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	fs, vs, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("g")}, fs)
+	assert.Equal(t, [][]byte{[]byte("2")}, vs)
+}
+
+func TestHDelSurvivors(t *testing.T) {
+	key := []byte("hdel-survivors")
+	fields := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	setHashFields(t, key, fields, fields)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	// a stored Len below the fields present must not make a partial delete destroy the hash
+	hash.meta.Len = 2
+	n, destroyed, err := hash.HDelEx([][]byte{[]byte("a"), []byte("c"), []byte("a")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), n)
+	assert.False(t, destroyed)
+	assert.Equal(t, int64(2), hash.HLen())
+
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	fs, _, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("d")}, fs)
+	assert.Empty(t, hash.SelfCheck())
+}
+
+func TestHGetAllOrderSharedPrefixes(t *testing.T) {
+	prefix := strings.Repeat("shared-prefix/", 20)
+	var fields [][]byte
+	for i := 0; i < 3000; i++ {
+		fields = append(fields, []byte(fmt.Sprintf("%s%d/%x", prefix, i%7, i)))
+	}
+	want := make([][]byte, len(fields))
+	copy(want, fields)
+	sort.Slice(want, func(i, j int) bool { return bytes.Compare(want[i], want[j]) < 0 })
+
+	keys := []string{"hash-shared-prefix-1", "hash-shared-prefix-2"}
+	for i, key := range keys {
+		shuffled := make([][]byte, len(fields))
+		copy(shuffled, fields)
+		r := rand.New(rand.NewSource(int64(i)))
+		r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		setHashFields(t, []byte(key), shuffled, shuffled)
+	}
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	for _, key := range keys {
+		for run := 0; run < 3; run++ {
+			hash, err := txn.Hash([]byte(key))
+			assert.NoError(t, err)
+			fs, vs, err := hash.HGetAll()
+			assert.NoError(t, err)
+			assert.Equal(t, want, fs)
+			assert.Equal(t, want, vs)
+		}
+	}
+}
+
+func TestHMoveField(t *testing.T) {
+	src, dst := []byte("hmove-src"), []byte("hmove-dst")
+	setHashFields(t, src, [][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")})
+	setHashFields(t, dst, [][]byte{[]byte("c")}, [][]byte{[]byte("3")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+
+	moved, err := HMoveField(txn, src, dst, []byte("a"))
+	assert.NoError(t, err)
+	assert.True(t, moved)
+	moved, err = HMoveField(txn, src, dst, []byte("x"))
+	assert.NoError(t, err)
+	assert.False(t, moved)
+
+	hash, err := txn.Hash(src)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), hash.HLen())
+	val, err := hash.HGet([]byte("a"))
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+
+	hash, err = txn.Hash(dst)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), hash.HLen())
+	val, err = hash.HGet([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), val)
+}
+
+func TestHIncrByNotANumber(t *testing.T) {
+	key := []byte("hincrby-binary")
+	binary := []byte{0xde, 0xad, 0xbe, 0xef}
+	setHashFields(t, key, [][]byte{[]byte("bin")}, [][]byte{binary})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	_, err = hash.HIncrBy([]byte("bin"), 1)
+	assert.Equal(t, &FieldError{Field: []byte("bin"), Err: ErrNotAnInteger}, err)
+	_, err = hash.HIncrByFloat([]byte("bin"), 1.5)
+	assert.Equal(t, &FieldError{Field: []byte("bin"), Err: ErrNotAFloat}, err)
+
+	val, err := hash.HGet([]byte("bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, binary, val)
+	assert.Equal(t, int64(1), hash.HLen())
+}
+
+func TestHLenReadRepair(t *testing.T) {
+	key := []byte("hlen-read-repair")
+	setHashFields(t, key, [][]byte{[]byte("a"), []byte("b"), []byte("c")}, [][]byte{[]byte("1"), []byte("2"), []byte("3")})
+
+	drift := func() {
+		txn, err := mockDB.Begin()
+		assert.NoError(t, err)
+		hash, err := txn.Hash(key)
+		assert.NoError(t, err)
+		hash.meta.Len = 10
+		assert.NoError(t, hash.updateMeta())
+		assert.NoError(t, txn.Commit(context.TODO()))
+	}
+	hlen := func() int64 {
+		txn, err := mockDB.Begin()
+		assert.NoError(t, err)
+		hash, err := txn.Hash(key)
+		assert.NoError(t, err)
+		n := hash.HLen()
+		assert.NoError(t, txn.Commit(context.TODO()))
+		return n
+	}
+
+	drift()
+	assert.Equal(t, int64(10), hlen())
+
+	SetReadRepair(10)
+	defer SetReadRepair(-1)
+	assert.Equal(t, int64(10), hlen())
+
+	SetReadRepair(1)
+	assert.Equal(t, int64(3), hlen())
+	SetReadRepair(-1)
+	assert.Equal(t, int64(3), hlen())
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	n, err := hash.HLenVerified()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+}
+
+// cancelIter cancels a context once n entries are consumed
+type cancelIter struct {
+	trackIter
+	n      int
+	cancel context.CancelFunc
+}
+
+func (it *cancelIter) Next() error {
+	if it.n--; it.n == 0 {
+		it.cancel()
+	}
+	return it.trackIter.Next()
+}
+
+func TestHGetAllCtx(t *testing.T) {
+	key := []byte("hgetall-ctx")
+	var fields [][]byte
+	for i := 0; i < 10; i++ {
+		fields = append(fields, []byte(fmt.Sprintf("f%d", i)))
+	}
+	setHashFields(t, key, fields, fields)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var iter *cancelIter
+	txn.t = &faultTxn{Transaction: txn.t, seek: func(t store.Transaction, k kv.Key) (kv.Iterator, error) {
+		it, err := t.Seek(k)
+		if err != nil {
+			return nil, err
+		}
+		iter = &cancelIter{trackIter: trackIter{Iterator: it}, n: 3, cancel: cancel}
+		return iter, nil
+	}}
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	fs, vs, err := hash.HGetAllCtx(ctx)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, fs)
+	assert.Nil(t, vs)
+	assert.True(t, iter.closed)
+
+	fs, _, err = hash.HGetAllCtx(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+	assert.True(t, iter.closed)
+}
+
+func TestHScanCursorProgress(t *testing.T) {
+	key := []byte("hscan-progress")
+	var fields [][]byte
+	for i := 0; i < 256; i += 3 {
+		fields = append(fields, []byte{byte(i), 'x'})
+	}
+	setHashFields(t, key, fields, fields)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	cursor, err := ParseHScanCursor([]byte("0"))
+	assert.NoError(t, err)
+	assert.Equal(t, float64(0), cursor.Progress())
+	last := cursor.Progress()
+	for cursor != nil {
+		cursor, _, _, err = hash.HScan(cursor, nil, 10)
+		assert.NoError(t, err)
+		assert.True(t, cursor.Progress() >= last)
+		if cursor != nil {
+			assert.True(t, cursor.Progress() < 1)
+		}
+		last = cursor.Progress()
+	}
+	assert.Equal(t, float64(1), last)
+}
+
+func TestHAnyAllExist(t *testing.T) {
+	key := []byte("hash-any-all-exist")
+	setHashFields(t, key, [][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	for _, c := range []struct {
+		fields   []string
+		any, all bool
+	}{
+		{[]string{"x", "y"}, false, false},
+		{[]string{"x", "b"}, true, false},
+		{[]string{"a", "b"}, true, true},
+	} {
+		var fields [][]byte
+		for _, f := range c.fields {
+			fields = append(fields, []byte(f))
+		}
+		any, err := hash.HAnyExists(fields)
+		assert.NoError(t, err)
+		assert.Equal(t, c.any, any, "%v", c.fields)
+		all, err := hash.HAllExist(fields)
+		assert.NoError(t, err)
+		assert.Equal(t, c.all, all, "%v", c.fields)
+	}
+
+	// a field ruled out by the bloom filter answers without reading the store
+	assert.NoError(t, hash.EnableBloomFilter(1024))
+	counter := &countTxn{Transaction: txn.t}
+	txn.t = counter
+	missing := [][]byte{[]byte("a"), []byte("missing")}
+	assert.True(t, hash.bloomRejects(missing[1]))
+	all, err := hash.HAllExist(missing)
+	assert.NoError(t, err)
+	assert.False(t, all)
+	any, err := hash.HAnyExists(missing[1:])
+	assert.NoError(t, err)
+	assert.False(t, any)
+	assert.Equal(t, 0, counter.calls)
+}
+
+func TestMaxHashFields(t *testing.T) {
+	SetMaxHashFields(3)
+	defer SetMaxHashFields(0)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-max-fields"))
+	assert.NoError(t, err)
+
+	// a repeated field is counted once
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("a"), []byte("b"), []byte("a")}, [][]byte{[]byte("1"), []byte("2"), []byte("3")}))
+	assert.Equal(t, int64(2), hash.HLen())
+	n, err := hash.HSet([]byte("c"), []byte("3"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, int64(3), hash.HLen())
+
+	_, err = hash.HSet([]byte("d"), []byte("4"))
+	assert.Equal(t, ErrHashFull, err)
+	_, err = hash.HIncrBy([]byte("d"), 1)
+	assert.Equal(t, ErrHashFull, err)
+	assert.Equal(t, ErrHashFull, hash.HMSet([][]byte{[]byte("a"), []byte("d")}, [][]byte{[]byte("1"), []byte("4")}))
+	val, err := hash.HGet([]byte("d"))
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	val, err = hash.HGet([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("3"), val)
+
+	// overwriting is always allowed
+	n, err = hash.HSet([]byte("a"), []byte("x"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("b"), []byte("c")}, [][]byte{[]byte("y"), []byte("z")}))
+	assert.Equal(t, int64(3), hash.HLen())
+}
+
+func TestWrittenKeys(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-written-keys"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), txn.WrittenKeys())
+
+	var fields [][]byte
+	for i := 0; i < 100; i++ {
+		fields = append(fields, []byte(fmt.Sprintf("f%03d", i)))
+	}
+	assert.NoError(t, hash.HMSet(fields, fields))
+	assert.Equal(t, int64(101), txn.WrittenKeys())
+
+	// reads write nothing
+	_, _, err = hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(101), txn.WrittenKeys())
+
+	_, err = hash.HDel(fields[:1])
+	assert.NoError(t, err)
+	assert.Equal(t, int64(103), txn.WrittenKeys())
+
+	// the writes outside the hash are counted too, here the meta deleted and the GC key
+	assert.NoError(t, hash.Destory())
+	assert.Equal(t, int64(105), txn.WrittenKeys())
+}
+
+func TestHMGetMatch(t *testing.T) {
+	key := []byte("hmget-match")
+	fields := [][]byte{[]byte("a"), []byte("session:1"), []byte("session:2"), []byte("user:1"), []byte("user:2"), []byte("user:admin"), []byte("z")}
+	setHashFields(t, key, fields, fields)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	fs, vs, err := hash.HMGetMatch([]string{"user:*", "session:*"}, 0)
+	assert.NoError(t, err)
+	want := [][]byte{[]byte("session:1"), []byte("session:2"), []byte("user:1"), []byte("user:2"), []byte("user:admin")}
+	assert.Equal(t, want, fs)
+	assert.Equal(t, want, vs)
+
+	// overlapping patterns yield every field once
+	fs, _, err = hash.HMGetMatch([]string{"user:*", "user:[0-9]", "*:1"}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("session:1"), []byte("user:1"), []byte("user:2"), []byte("user:admin")}, fs)
+
+	fs, _, err = hash.HMGetMatch([]string{"user:*", "session:*"}, 3)
+	assert.NoError(t, err)
+	assert.Equal(t, want[:3], fs)
+
+	fs, _, err = hash.HMGetMatch([]string{"nothing*"}, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, fs)
+}
+
+func TestHMGetMatchEmptyField(t *testing.T) {
+	key := []byte("hmget-match-empty-field")
+	fields := [][]byte{[]byte(""), []byte("a"), []byte("ab")}
+	values := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
+	setHashFields(t, key, fields, values)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	fs, vs, err := hash.HMGetMatch([]string{"a*", "?", "[a-z]"}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, fields[1:], fs)
+	assert.Equal(t, values[1:], vs)
+
+	fs, _, err = hash.HMGetMatch([]string{"*"}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+}
+
+func TestHashETag(t *testing.T) {
+	key := []byte("hash-etag")
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	etag := func() string {
+		hash, err := txn.Hash(key)
+		assert.NoError(t, err)
+		tag, err := hash.ETag()
+		assert.NoError(t, err)
+		return tag
+	}
+	missing := etag()
+	assert.Equal(t, missing, etag())
+
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")}))
+	tag := etag()
+	assert.NotEqual(t, missing, tag)
+
+	// reads and writes of the same values leave it alone
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	_, _, err = hash.HGetAll()
+	assert.NoError(t, err)
+	_, err = hash.HSet([]byte("a"), []byte("1"))
+	assert.NoError(t, err)
+	assert.Equal(t, tag, etag())
+
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	_, err = hash.HSet([]byte("a"), []byte("changed"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, tag, etag())
+	tag = etag()
+
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	_, err = hash.HDel([][]byte{[]byte("b")})
+	assert.NoError(t, err)
+	assert.NotEqual(t, tag, etag())
+}
+
+func TestMaxScanKeys(t *testing.T) {
+	key := []byte("hash-max-scan-keys")
+	var fields [][]byte
+	for i := 0; i < 5; i++ {
+		fields = append(fields, []byte(fmt.Sprintf("f%d", i)))
+	}
+	setHashFields(t, key, fields, fields)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	SetMaxScanKeys(5)
+	defer SetMaxScanKeys(0)
+	fs, _, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+
+	SetMaxScanKeys(4)
+	_, _, err = hash.HGetAll()
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	_, _, _, err = hash.HScan(nil, []byte("x*"), 10)
+	assert.NoError(t, err)
+	_, _, _, err = hash.HScan(nil, []byte("*9"), 10)
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	_, _, err = hash.HMGetMatch([]string{"f*"}, 0)
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	_, _, err = hash.HGetAllExcept(fields[:2])
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	_, _, err = hash.HDelMatch("f*", true)
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	_, err = hash.HTrim(1)
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	fieldc, errc := hash.HStream(context.Background())
+	for range fieldc {
+	}
+	assert.Equal(t, ErrScanLimitExceeded, <-errc)
+	_, err = hash.HLenVerified()
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	_, _, err = hash.HGetAllStrict()
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	_, _, err = hash.HGetAllLazy()
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	_, _, _, err = hash.HGetAllPacked()
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	_, _, err = hash.HMaxField()
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	_, err = hash.DistinctValueCount(0)
+	assert.Equal(t, ErrScanLimitExceeded, err)
+	// a sample within the limit is fine
+	_, err = hash.DistinctValueCount(4)
+	assert.NoError(t, err)
+
+	// read repair keeps the stored Len when the count hits the limit
+	SetReadRepair(0)
+	hash.meta.Len = 3
+	assert.Equal(t, int64(3), hash.HLen())
+	SetReadRepair(-1)
+	hash.meta.Len = 5
+
+	// a page within the limit is fine
+	next, fs, _, err := hash.HScan(nil, nil, 2)
+	assert.NoError(t, err)
+	assert.NotNil(t, next)
+	assert.Equal(t, fields[:2], fs)
+}
+
+func TestHGetAllReverse(t *testing.T) {
+	key := []byte("hgetall-reverse")
+	fields := [][]byte{[]byte("1500000000"), []byte("1500000001"), []byte("1600000000"), []byte("a"), {0xff}}
+	setHashFields(t, key, fields, fields)
+	want := make([][]byte, len(fields))
+	for i := range fields {
+		want[len(fields)-1-i] = fields[i]
+	}
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	fs, vs, err := hash.HGetAllReverse()
+	assert.NoError(t, err)
+	assert.Equal(t, want, fs)
+	assert.Equal(t, want, vs)
+
+	// iterate backward on a store supporting reverse seeks
+	buf := kv.NewMemDbBuffer(0)
+	iter, err := txn.t.Seek(DataKey(mockDB, hash.meta.ID))
+	assert.NoError(t, err)
+	for iter.Valid() {
+		assert.NoError(t, buf.Set(iter.Key(), iter.Value()))
+		assert.NoError(t, iter.Next())
+	}
+	iter.Close()
+	txn.t = &faultTxn{Transaction: txn.t, seekReverse: func(t store.Transaction, k kv.Key) (kv.Iterator, error) {
+		return buf.SeekReverse(k)
+	}}
+	fs, vs, err = hash.HGetAllReverse()
+	assert.NoError(t, err)
+	assert.Equal(t, want, fs)
+	assert.Equal(t, want, vs)
+
+	// the stores return ErrNotImplemented traced, which still selects the fallback
+	txn.t.(*faultTxn).seekReverse = func(store.Transaction, kv.Key) (kv.Iterator, error) {
+		return nil, jerrors.Trace(kv.ErrNotImplemented)
+	}
+	fs, vs, err = hash.HGetAllReverse()
+	assert.NoError(t, err)
+	assert.Equal(t, want, fs)
+	assert.Equal(t, want, vs)
+
+	// any other error is returned
+	txn.t.(*faultTxn).seekReverse = func(store.Transaction, kv.Key) (kv.Iterator, error) {
+		return nil, jerrors.Trace(errInjected)
+	}
+	_, _, err = hash.HGetAllReverse()
+	assert.Equal(t, errInjected, jerrors.Cause(err))
+}
+
+func TestHDelMatchAll(t *testing.T) {
+	key := []byte("hdelmatch-all")
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	fields := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	assert.NoError(t, hash.HMSet(fields, fields))
+	assert.NoError(t, hash.EnableInsertionOrder())
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	dkey := DataKey(mockDB, hash.meta.ID)
+	// the hash is destroyed without being scanned
+	txn.t = &faultTxn{Transaction: txn.t, seek: func(store.Transaction, kv.Key) (kv.Iterator, error) {
+		return nil, errInjected
+	}}
+	removed, n, err := hash.HDelMatch("*", false)
+	assert.NoError(t, err)
+	assert.Nil(t, removed)
+	assert.Equal(t, int64(3), n)
+	// only the meta is deleted and the data is added to GC, no field is deleted one by one
+	assert.Equal(t, int64(2), txn.WrittenKeys())
+	txn.t = txn.t.(*faultTxn).Transaction
+	removed, n, err = hash.HDelMatch("*", false)
+	assert.NoError(t, err)
+	assert.Nil(t, removed)
+	assert.Equal(t, int64(0), n)
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	assert.NoError(t, doGC(mockDB, 1000))
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	_, err = txn.t.Get(MetaKey(mockDB, key))
+	assert.True(t, IsErrNotFound(err))
+	iter, err := txn.t.Seek(dkey)
+	assert.NoError(t, err)
+	defer iter.Close()
+	assert.False(t, iter.Valid() && iter.Key().HasPrefix(dkey))
+}
+
+func TestHDelMatchDriftedLen(t *testing.T) {
+	key := []byte("hdelmatch-drifted-len")
+	fields := [][]byte{[]byte("a1"), []byte("a2"), []byte("b")}
+	setHashFields(t, key, fields, fields)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	// a stored Len below the fields present must not make a partial match destroy the hash
+	hash.meta.Len = 2
+	removed, n, err := hash.HDelMatch("a*", false)
+	assert.NoError(t, err)
+	assert.Equal(t, fields[:2], removed)
+	assert.Equal(t, int64(2), n)
+	assert.Equal(t, int64(1), hash.meta.Len)
+	fs, _, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, fields[2:], fs)
+}
+
+// deleteRecorder records the keys deleted through it
+type deleteRecorder struct {
+	deleted [][]byte
+}
+
+func (r *deleteRecorder) BeforeWrite(op WriteOp, key, value []byte) error {
+	if op == WriteDelete {
+		r.deleted = append(r.deleted, key)
+	}
+	return nil
+}
+
+func TestHSetKeepTTL(t *testing.T) {
+	key := []byte("hset-keep-ttl")
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	_, err = hash.HSet([]byte("f"), []byte("v"))
+	assert.NoError(t, err)
+
+	mkey := MetaKey(mockDB, key)
+	at := Now() + int64(time.Hour)
+	assert.NoError(t, expireAt(txn.t, mkey, hash.meta.ID, 0, at))
+	hash.meta.ExpireAt = at
+	assert.NoError(t, hash.updateMeta())
+
+	expireAtOf := func() int64 {
+		hash, err := txn.Hash(key)
+		assert.NoError(t, err)
+		return hash.meta.ExpireAt
+	}
+	_, err = hash.HSet([]byte("f"), []byte("v1"))
+	assert.NoError(t, err)
+	assert.Equal(t, at, expireAtOf())
+	_, err = hash.HSetWithOpts([]byte("f"), []byte("v2"), HSetOpts{KeepTTL: true})
+	assert.NoError(t, err)
+	assert.Equal(t, at, expireAtOf())
+
+	// clearing the expiration writes the meta once, even for an unchanged value, and the expire key is
+	// removed through the write interceptor
+	metas := 0
+	txn.t = &faultTxn{Transaction: txn.t, set: func(t store.Transaction, k kv.Key, v []byte) error {
+		if bytes.Equal(k, mkey) {
+			metas++
+		}
+		return t.Set(k, v)
+	}}
+	rec := &deleteRecorder{}
+	txn.SetWriteInterceptor(rec)
+	n, err := hash.HSetWithOpts([]byte("f"), []byte("v2"), HSetOpts{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, 1, metas)
+	assert.Equal(t, [][]byte{expireKey(mkey, at)}, rec.deleted)
+	assert.Equal(t, int64(0), expireAtOf())
+	_, err = txn.t.Get(expireKey(mkey, at))
+	assert.True(t, IsErrNotFound(err))
+}
+
+func TestHMSetDuplicateFields(t *testing.T) {
+	key := []byte("hmset-duplicate-fields")
+	setHashFields(t, key, [][]byte{[]byte("g")}, [][]byte{[]byte("old")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	assert.NoError(t, hash.EnableVersioning())
+
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("f"), []byte("f")}, [][]byte{[]byte("a"), []byte("b")}))
+	assert.Equal(t, int64(2), hash.HLen())
+	val, err := hash.HGet([]byte("f"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), val)
+	ver, err := hash.HVersion([]byte("f"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), ver)
+
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("g"), []byte("h"), []byte("g")}, [][]byte{[]byte("1"), []byte("2"), []byte("3")}))
+	assert.Equal(t, int64(3), hash.HLen())
+	vals, err := hash.HMGet([][]byte{[]byte("g"), []byte("h")})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("3"), []byte("2")}, vals)
+}
+
+func TestHDiff(t *testing.T) {
+	fields := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	setHashFields(t, []byte("hdiff-1"), fields, fields)
+	setHashFields(t, []byte("hdiff-2"), fields, fields)
+	setHashFields(t, []byte("hdiff-3"), [][]byte{[]byte("0"), []byte("b"), []byte("c"), []byte("d")},
+		[][]byte{[]byte("0"), []byte("b"), []byte("changed"), []byte("d")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+
+	onlyA, onlyB, mismatch, err := HDiff(txn, []byte("hdiff-1"), []byte("hdiff-2"))
+	assert.NoError(t, err)
+	assert.Empty(t, onlyA)
+	assert.Empty(t, onlyB)
+	assert.Empty(t, mismatch)
+
+	onlyA, onlyB, mismatch, err = HDiff(txn, []byte("hdiff-1"), []byte("hdiff-3"))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a")}, onlyA)
+	assert.Equal(t, [][]byte{[]byte("0"), []byte("d")}, onlyB)
+	assert.Equal(t, [][]byte{[]byte("c")}, mismatch)
+
+	onlyA, onlyB, mismatch, err = HDiff(txn, []byte("hdiff-1"), []byte("hdiff-missing"))
+	assert.NoError(t, err)
+	assert.Equal(t, fields, onlyA)
+	assert.Empty(t, onlyB)
+	assert.Empty(t, mismatch)
+}
+
+func TestHashInline(t *testing.T) {
+	SetInlineHashLimits(3, 64)
+	defer SetInlineHashLimits(0, 0)
+
+	key := []byte("hash-inline")
+	dataKeys := func(txn *Transaction, hash *Hash) int {
+		prefix := DataKey(txn.db, hash.meta.ID)
+		iter, err := txn.t.Seek(prefix)
+		assert.NoError(t, err)
+		defer iter.Close()
+		n := 0
+		for iter.Valid() && iter.Key().HasPrefix(prefix) {
+			n++
+			assert.NoError(t, iter.Next())
+		}
+		return n
+	}
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")}))
+	n, err := hash.HSet([]byte("c"), []byte("3"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	// the fields are only kept in the meta
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectEncodingListpack, hash.meta.Encoding)
+	assert.NoError(t, hash.Validate())
+	assert.Equal(t, 0, dataKeys(txn, hash))
+	assert.Equal(t, int64(3), hash.HLen())
+	val, err := hash.HGet([]byte("b"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), val)
+	n, err = hash.HSet([]byte("b"), []byte("x"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	deleted, err := hash.HDel([][]byte{[]byte("a")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), deleted)
+	fields, vals, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, fields)
+	assert.Equal(t, [][]byte{[]byte("x"), []byte("3")}, vals)
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	fields, vals, err = NewSnapshotReader(txn).ReadHashAll(key)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c")}, fields)
+	assert.Equal(t, [][]byte{[]byte("x"), []byte("3")}, vals)
+
+	// growing beyond the limits converts the hash to a plain hash table
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("d"), []byte("e")}, [][]byte{[]byte("4"), []byte("5")}))
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectEncodingHT, hash.meta.Encoding)
+	assert.Nil(t, hash.meta.Inline)
+	assert.Equal(t, 4, dataKeys(txn, hash))
+	assert.Equal(t, int64(4), hash.HLen())
+	fields, vals, err = hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("b"), []byte("c"), []byte("d"), []byte("e")}, fields)
+	assert.Equal(t, [][]byte{[]byte("x"), []byte("3"), []byte("4"), []byte("5")}, vals)
+
+	// a large value converts the hash as well
+	hash, err = txn.Hash([]byte("hash-inline-large"))
+	assert.NoError(t, err)
+	_, err = hash.HSet([]byte("a"), []byte("1"))
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectEncodingListpack, hash.meta.Encoding)
+	_, err = hash.HSet([]byte("b"), bytes.Repeat([]byte("x"), 64))
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectEncodingHT, hash.meta.Encoding)
+	assert.Equal(t, 2, dataKeys(txn, hash))
+	val, err = hash.HGet([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), val)
+	assert.NoError(t, txn.Rollback())
+}
+
+func TestHashInlineMetaWrites(t *testing.T) {
+	SetInlineHashLimits(4, 64)
+	defer SetInlineHashLimits(0, 0)
+
+	key := []byte("hash-inline-meta-writes")
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	mkey := MetaKey(mockDB, key)
+	metas := 0
+	txn.t = &faultTxn{Transaction: txn.t, set: func(t store.Transaction, k kv.Key, v []byte) error {
+		if bytes.Equal(k, mkey) {
+			metas++
+		}
+		return t.Set(k, v)
+	}}
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	fields := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	assert.NoError(t, hash.HMSet(fields, fields))
+	assert.Equal(t, ObjectEncodingListpack, hash.meta.Encoding)
+	assert.Equal(t, 1, metas)
+
+	// the promoted entries are written through the interceptor
+	limiter := &sizeLimiter{max: 64}
+	txn.SetWriteInterceptor(limiter)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("d"), []byte("e")}, [][]byte{[]byte("4"), []byte("5")}))
+	assert.Equal(t, ObjectEncodingHT, hash.meta.Encoding)
+	assert.Equal(t, 2, metas)
+	// the two new fields, the five promoted entries and the meta
+	assert.Equal(t, 8, limiter.writes)
+}
+
+func TestHashInlineDowngrade(t *testing.T) {
+	SetInlineHashLimits(3, 64)
+	defer SetInlineHashLimits(0, 0)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-inline-downgrade"))
+	assert.NoError(t, err)
+	fields := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}
+	assert.NoError(t, hash.HMSet(fields, fields))
+	assert.Equal(t, ObjectEncodingHT, hash.meta.Encoding)
+
+	// dropping to the limit is not enough
+	_, err = hash.HDel([][]byte{[]byte("a"), []byte("b")})
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectEncodingHT, hash.meta.Encoding)
+
+	_, err = hash.HDel([][]byte{[]byte("c")})
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectEncodingListpack, hash.meta.Encoding)
+	dkey := DataKey(txn.db, hash.meta.ID)
+	iter, err := txn.t.Seek(dkey)
+	assert.NoError(t, err)
+	assert.False(t, iter.Valid() && iter.Key().HasPrefix(dkey))
+	iter.Close()
+
+	hash, err = txn.Hash([]byte("hash-inline-downgrade"))
+	assert.NoError(t, err)
+	assert.Equal(t, ObjectEncodingListpack, hash.meta.Encoding)
+	assert.Equal(t, int64(2), hash.HLen())
+	fs, vs, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, fields[3:], fs)
+	assert.Equal(t, fields[3:], vs)
+	val, err := hash.HGet([]byte("d"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("d"), val)
+}
+
+func TestHGetAllTransform(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hgetall-transform"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("password"), []byte("user")}, [][]byte{[]byte("secret"), []byte("alice")}))
+
+	mask := []byte("******")
+	fields, vals, err := hash.HGetAllTransform(func(field, value []byte) []byte {
+		if string(field) == "password" {
+			return mask
+		}
+		return value
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("password"), []byte("user")}, fields)
+	assert.Equal(t, [][]byte{mask, []byte("alice")}, vals)
+
+	// the stored value is left untouched
+	val, err := hash.HGet([]byte("password"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), val)
+}
+
+func TestHGetAllExcept(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hgetall-except"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet(
+		[][]byte{[]byte("password"), []byte("token"), []byte("user")},
+		[][]byte{[]byte("secret"), []byte("abc"), []byte("alice")}))
+
+	fields, vals, err := hash.HGetAllExcept([][]byte{[]byte("password"), []byte("token")})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("user")}, fields)
+	assert.Equal(t, [][]byte{[]byte("alice")}, vals)
+
+	// the denied fields are still stored
+	val, err := hash.HGet([]byte("password"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), val)
+	val, err = hash.HGet([]byte("token"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("abc"), val)
+
+	fields, _, err = hash.HGetAllExcept(nil)
+	assert.NoError(t, err)
+	assert.Len(t, fields, 3)
+}
+
+func TestHashBytes(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-bytes"))
+	assert.NoError(t, err)
+	usage := func() int64 {
+		n, err := hash.MemoryUsage()
+		assert.NoError(t, err)
+		return n
+	}
+
+	_, err = hash.HSet([]byte("a"), []byte("123"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), usage())
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("bb"), []byte("cc")}, [][]byte{[]byte("1"), []byte("12")}))
+	assert.Equal(t, int64(11), usage())
+
+	// an overwrite counts the difference of the values
+	_, err = hash.HSet([]byte("a"), []byte("1"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9), usage())
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("bb"), []byte("d")}, [][]byte{[]byte("12345"), []byte("x")}))
+	assert.Equal(t, int64(15), usage())
+	_, err = hash.HIncrBy([]byte("cc"), 100)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(16), usage())
+
+	_, err = hash.HDel([][]byte{[]byte("bb"), []byte("missing")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(9), usage())
+	_, _, err = hash.HDelMatch("d", false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), usage())
+
+	// the value sizes are not affected by compression
+	assert.NoError(t, hash.EnableCompression())
+	_, err = hash.HSet([]byte("e"), bytes.Repeat([]byte("x"), 1000))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1008), usage())
+	_, err = hash.HTrim(2)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), usage())
+
+	fields, vals, err := hash.HGetAll()
+	assert.NoError(t, err)
+	var n int64
+	for i := range fields {
+		n += int64(len(fields[i]) + len(vals[i]))
+	}
+	assert.Equal(t, n, hash.meta.Bytes)
+
+	// the hashes from before the size was kept are scanned
+	hash.meta.Flags &^= HashFlagSized
+	hash.meta.Bytes = 0
+	assert.Equal(t, int64(7), usage())
+}
+
+// countTxn counts the calls reaching the store
+type countTxn struct {
+	store.Transaction
+	calls int
+}
+
+func (c *countTxn) Get(k kv.Key) ([]byte, error) {
+	c.calls++
+	return c.Transaction.Get(k)
+}
+
+func (c *countTxn) Seek(k kv.Key) (kv.Iterator, error) {
+	c.calls++
+	return c.Transaction.Seek(k)
+}
+
+func (c *countTxn) Set(k kv.Key, v []byte) error {
+	c.calls++
+	return c.Transaction.Set(k, v)
+}
+
+func (c *countTxn) Delete(k kv.Key) error {
+	c.calls++
+	return c.Transaction.Delete(k)
+}
+
+func (c *countTxn) GetSnapshot() kv.Snapshot {
+	c.calls++
+	return c.Transaction.GetSnapshot()
+}
+
+func TestHashBloomFilter(t *testing.T) {
+	key := []byte("hash-bloom")
+	setHashFields(t, key, [][]byte{[]byte("a")}, [][]byte{[]byte("1")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	absent, err := txn.Hash([]byte("hash-bloom-missing"))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrKeyNotFound, absent.EnableBloomFilter(1024))
+	assert.Equal(t, ErrOutOfRange, hash.EnableBloomFilter(0))
+	assert.Equal(t, ErrOutOfRange, hash.EnableBloomFilter(hashBloomMaxBits+1))
+	assert.Nil(t, hash.meta.Bloom)
+	assert.NoError(t, hash.EnableBloomFilter(1024))
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("b"), []byte("c")}, [][]byte{[]byte("2"), []byte("3")}))
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	var missing []byte
+	for i := 0; missing == nil; i++ {
+		if field := []byte(fmt.Sprintf("missing-%d", i)); hash.bloomRejects(field) {
+			missing = field
+		}
+	}
+	counter := &countTxn{Transaction: txn.t}
+	txn.t = counter
+
+	// a definite negative is answered from the meta
+	val, err := hash.HGet(missing)
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	exists, err := hash.HExists(missing)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, 0, counter.calls)
+
+	// the fields set before and after enabling the filter do the real lookup
+	for _, field := range []string{"a", "c"} {
+		counter.calls = 0
+		exists, err = hash.HExists([]byte(field))
+		assert.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, 1, counter.calls)
+	}
+
+	// a deleted field stays in the filter
+	_, err = hash.HDel([][]byte{[]byte("b")})
+	assert.NoError(t, err)
+	assert.False(t, hash.bloomRejects([]byte("b")))
+	counter.calls = 0
+	val, err = hash.HGet([]byte("b"))
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	assert.Equal(t, 1, counter.calls)
+}
+
+func TestHashEmptyInput(t *testing.T) {
+	key := []byte("hash-empty-input")
+	setHashFields(t, key, [][]byte{[]byte("a")}, [][]byte{[]byte("1")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	counter := &countTxn{Transaction: txn.t}
+	txn.t = counter
+
+	vals, err := hash.HMGet(nil)
+	assert.NoError(t, err)
+	assert.Len(t, vals, 0)
+	assert.NoError(t, hash.HMSet(nil, nil))
+	n, err := hash.HDel([][]byte{})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+	assert.Equal(t, 0, counter.calls)
+
+	// a new hash is not created by an empty HMSet
+	hash, err = txn.Hash([]byte("hash-empty-input-new"))
+	assert.NoError(t, err)
+	counter.calls = 0
+	assert.NoError(t, hash.HMSet([][]byte{}, [][]byte{}))
+	assert.Equal(t, 0, counter.calls)
+}
+
+func TestMaxValueSize(t *testing.T) {
+	SetMaxValueSize(4)
+	defer SetMaxValueSize(0)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-max-value-size"))
+	assert.NoError(t, err)
+
+	n, err := hash.HSet([]byte("a"), []byte("1234"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = hash.HSet([]byte("a"), []byte("12345"))
+	assert.Equal(t, ErrValueTooLarge, err)
+	val, err := hash.HGet([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1234"), val)
+
+	// a rejected HMSet writes none of its fields
+	err = hash.HMSet([][]byte{[]byte("b"), []byte("c")}, [][]byte{[]byte("1"), []byte("12345")})
+	assert.Equal(t, ErrValueTooLarge, err)
+	vals, err := hash.HMGet([][]byte{[]byte("b"), []byte("c")})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{nil, nil}, vals)
+	assert.Equal(t, int64(1), hash.HLen())
+}
+
+func TestMaxFieldLen(t *testing.T) {
+	SetMaxFieldLen(4)
+	defer SetMaxFieldLen(0)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-max-field-len"))
+	assert.NoError(t, err)
+
+	n, err := hash.HSet([]byte("abcd"), []byte("v"))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	_, err = hash.HSet([]byte("abcde"), []byte("v"))
+	assert.Equal(t, ErrFieldTooLong, err)
+	_, err = hash.HSetNX([]byte("abcde"), []byte("v"))
+	assert.Equal(t, ErrFieldTooLong, err)
+	_, err = hash.HIncrBy([]byte("abcde"), 1)
+	assert.Equal(t, ErrFieldTooLong, err)
+	_, err = hash.HIncrByFloat([]byte("abcde"), 1.5)
+	assert.Equal(t, ErrFieldTooLong, err)
+
+	// a rejected HMSet writes none of its fields
+	err = hash.HMSet([][]byte{[]byte("b"), []byte("ccccc")}, [][]byte{[]byte("1"), []byte("2")})
+	assert.Equal(t, ErrFieldTooLong, err)
+	vals, err := hash.HMGet([][]byte{[]byte("b"), []byte("ccccc")})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{nil, nil}, vals)
+	assert.Equal(t, int64(1), hash.HLen())
+
+	// swapping with a missing over-length field would create it
+	assert.Equal(t, ErrFieldTooLong, hash.HSwap([]byte("abcd"), []byte("abcde")))
+	vals, err = hash.HMGet([][]byte{[]byte("abcd"), []byte("abcde")})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("v"), nil}, vals)
+}
+
+func TestHashScansCloseIterators(t *testing.T) {
+	key := []byte("hash-scan-close")
+	fields := [][]byte{[]byte("f1"), []byte("f2"), []byte("f3"), []byte("f4")}
+	setHashFields(t, key, fields, fields)
+
+	scans := map[string]func(hash *Hash) error{
+		"HGetAll": func(hash *Hash) error {
+			_, _, err := hash.HGetAll()
+			return err
+		},
+		"HScan": func(hash *Hash) error {
+			_, _, _, err := hash.HScan(nil, nil, 10)
+			return err
+		},
+		"HMGetMatch": func(hash *Hash) error {
+			_, _, err := hash.HMGetMatch([]string{"f*"}, 0)
+			return err
+		},
+		"HDelMatch": func(hash *Hash) error {
+			_, _, err := hash.HDelMatch("f*", true)
+			return err
+		},
+		"HLenVerified": func(hash *Hash) error {
+			_, err := hash.HLenVerified()
+			return err
+		},
+		"HTrim": func(hash *Hash) error {
+			_, err := hash.HTrim(1)
+			return err
+		},
+		"Iterator": func(hash *Hash) error {
+			it := hash.Iterator()
+			for it.Next() {
+			}
+			return it.Err()
+		},
+	}
+	for name, scan := range scans {
+		for _, fail := range []bool{false, true} {
+			txn, err := mockDB.Begin()
+			assert.NoError(t, err)
+			var iters []*trackIter
+			txn.t = &faultTxn{Transaction: txn.t, seek: func(t store.Transaction, k kv.Key) (kv.Iterator, error) {
+				it, err := t.Seek(k)
+				if err != nil {
+					return nil, err
+				}
+				if fail {
+					it = &faultIter{Iterator: it, n: 2}
+				}
+				iter := &trackIter{Iterator: it}
+				iters = append(iters, iter)
+				return iter, nil
+			}}
+			hash, err := txn.Hash(key)
+			assert.NoError(t, err)
+
+			err = scan(hash)
+			if fail {
+				assert.Equal(t, errInjected, err, name)
+			} else {
+				assert.NoError(t, err, name)
+			}
+			assert.NotEmpty(t, iters, name)
+			for _, iter := range iters {
+				assert.True(t, iter.closed, name)
+			}
+			assert.NoError(t, txn.Rollback())
+		}
+	}
+}
+
+func TestHashIterator(t *testing.T) {
+	key := []byte("hash-iterator")
+	fields := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	values := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
+	setHashFields(t, key, fields, values)
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+
+	var fs, vs [][]byte
+	it := hash.Iterator()
+	for it.Next() {
+		fs = append(fs, append([]byte{}, it.Field()...))
+		vs = append(vs, it.Value())
+	}
+	assert.NoError(t, it.Err())
+	assert.Equal(t, fields, fs)
+	assert.Equal(t, values, vs)
+	assert.False(t, it.Next())
+	it.Close()
+
+	// stopping early
+	it = hash.Iterator()
+	assert.True(t, it.Next())
+	assert.Equal(t, []byte("a"), it.Field())
+	it.Close()
+	assert.False(t, it.Next())
+	assert.NoError(t, it.Err())
+}
+
+func TestHScanWhere(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hscan-where"))
+	assert.NoError(t, err)
+	fields := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")}
+	values := [][]byte{[]byte("1"), []byte(`{"x":1}`), []byte("-20"), []byte("1.5"), []byte("300")}
+	assert.NoError(t, hash.HMSet(fields, values))
+
+	isInt := func(v []byte) bool {
+		_, err := strconv.ParseInt(string(v), 10, 64)
+		return err == nil
+	}
+	var fs, vs [][]byte
+	var cursor *HScanCursor
+	for {
+		next, f, v, err := hash.HScanWhere(cursor, []byte("*"), 2, isInt)
+		assert.NoError(t, err)
+		fs = append(fs, f...)
+		vs = append(vs, v...)
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("c"), []byte("e")}, fs)
+	assert.Equal(t, [][]byte{[]byte("1"), []byte("-20"), []byte("300")}, vs)
+
+	// the field pattern still applies
+	_, fs, _, err = hash.HScanWhere(nil, []byte("[a-c]"), 10, isInt)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("c")}, fs)
+}
+
+func TestHashMemTxn(t *testing.T) {
+	txn := &Transaction{t: store.NewMemTxn(), db: mockDB}
+	hash, err := txn.Hash([]byte("hash-mem-txn"))
+	assert.NoError(t, err)
+	fields := [][]byte{[]byte("b"), []byte("a"), []byte("c")}
+	assert.NoError(t, hash.HMSet(fields, fields))
+	n, err := hash.HDel([][]byte{[]byte("c")})
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), n)
+
+	hash, err = txn.Hash([]byte("hash-mem-txn"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), hash.HLen())
+	fs, vs, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, fs)
+	assert.Equal(t, fs, vs)
+	vals, err := hash.HMGet([][]byte{[]byte("a"), []byte("c")})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), nil}, vals)
+}
+
+func TestDecodeHashItemKey(t *testing.T) {
+	dkey := []byte("dkey")
+	field, err := DecodeHashItemKey(dkey, hashItemKey(dkey, []byte("f")))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("f"), field)
+	field, err = DecodeHashItemKey(dkey, hashItemKey(dkey, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{}, field)
+	for _, key := range []string{"dkey", "dkeyx:f", "other:f", "dke"} {
+		_, err = DecodeHashItemKey(dkey, []byte(key))
+		assert.Equal(t, ErrCorruptField, err, key)
+	}
+}
+
+func TestHGetAllStrict(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hgetall-strict"))
+	assert.NoError(t, err)
+	fields := [][]byte{[]byte("a"), []byte("b")}
+	assert.NoError(t, hash.HMSet(fields, fields))
+	assert.NoError(t, hash.EnableInsertionOrder())
+
+	// the sub keys are not corruption
+	fs, vs, err := hash.HGetAllStrict()
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+	assert.Equal(t, fields, vs)
+
+	bad := append(DataKey(txn.db, hash.meta.ID), []byte("junk")...)
+	assert.NoError(t, txn.t.Set(bad, []byte("x")))
+	fs, _, err = hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, fields, fs)
+	_, _, err = hash.HGetAllStrict()
+	kerr, ok := err.(*KeyError)
+	assert.True(t, ok)
+	assert.Equal(t, bad, kerr.Key)
+	assert.Equal(t, ErrCorruptField, kerr.Err)
+}
+
+func TestGetHashPrefix(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	_, err = txn.Hash([]byte("get-hash-prefix"))
+	assert.NoError(t, err)
+
+	// the ID of the DB is encoded as "001"
+	saved := keySeparator
+	keySeparator = []byte("0")
+	_, err = txn.Hash([]byte("get-hash-prefix"))
+	keySeparator = saved
+	assert.Equal(t, &KeyError{Key: mockDB.Prefix(), Err: ErrInvalidPrefix}, err)
+
+	db := &DB{Namespace: "ns:001", ID: mockDB.ID, kv: mockDB.kv}
+	txn, err = db.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	_, err = txn.Hash([]byte("get-hash-prefix"))
+	assert.Equal(t, &KeyError{Key: db.Prefix(), Err: ErrInvalidPrefix}, err)
+}
+
+func TestHGetAllReadYourWrites(t *testing.T) {
+	fields := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+	values := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
+	reads := map[string]func(hash *Hash) ([][]byte, [][]byte, error){
+		"HGetAll":       (*Hash).HGetAll,
+		"HGetAllStrict": (*Hash).HGetAllStrict,
+		"HScan": func(hash *Hash) ([][]byte, [][]byte, error) {
+			_, fs, vs, err := hash.HScan(nil, nil, 10)
+			return fs, vs, err
+		},
+	}
+	for _, inline := range []bool{false, true} {
+		if inline {
+			SetInlineHashLimits(10, 1024)
+		}
+		for name, read := range reads {
+			key := []byte(fmt.Sprintf("hgetall-read-your-writes-%s-%v", name, inline))
+			setHashFields(t, key, [][]byte{[]byte("a")}, [][]byte{[]byte("0")})
+
+			txn, err := mockDB.Begin()
+			assert.NoError(t, err)
+			hash, err := txn.Hash(key)
+			assert.NoError(t, err)
+			assert.NoError(t, hash.HMSet(fields[1:], values[1:]))
+			_, err = hash.HSet(fields[0], values[0])
+			assert.NoError(t, err)
+
+			// the next command of the pipeline reads the hash again
+			hash, err = txn.Hash(key)
+			assert.NoError(t, err)
+			fs, vs, err := read(hash)
+			assert.NoError(t, err, name)
+			assert.Equal(t, fields, fs, name)
+			assert.Equal(t, values, vs, name)
+			assert.NoError(t, txn.Rollback())
+		}
+		SetInlineHashLimits(0, 0)
+	}
+}
+
+func TestHashLabels(t *testing.T) {
+	key := []byte("hash-labels")
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, ErrKeyNotFound, hash.SetLabel("owner", "ops"))
+	labels, err := hash.Labels()
+	assert.NoError(t, err)
+	assert.Empty(t, labels)
+
+	_, err = hash.HSet([]byte("f"), []byte("v"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.SetLabel("owner", "ops"))
+	assert.NoError(t, hash.SetLabel("env", "prod"))
+	assert.NoError(t, hash.SetLabel("env", "staging"))
+	assert.NoError(t, hash.SetLabel("missing", ""))
+
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	labels, err = hash.Labels()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"owner": "ops", "env": "staging"}, labels)
+	fields, _, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("f")}, fields)
+	assert.Equal(t, int64(1), hash.HLen())
+
+	assert.Equal(t, ErrLabelsTooLarge, hash.SetLabel("big", strings.Repeat("x", hashLabelsMaxBytes)))
+	// overwriting a label only counts its new value
+	assert.NoError(t, hash.SetLabel("owner", strings.Repeat("x", hashLabelsMaxBytes-len("owner")-len("envstaging"))))
+	assert.NoError(t, hash.SetLabel("owner", ""))
+	labels, err = hash.Labels()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"env": "staging"}, labels)
+}
+
+func TestHLenPendingWrites(t *testing.T) {
+	key := []byte("hlen-pending-writes")
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	_, err = hash.HSet([]byte("f"), []byte("v"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), hash.HLen())
+	// a later command of the same transaction reads the uncommitted meta
+	hash, err = txn.Hash(key)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), hash.HLen())
+
+	assert.NoError(t, WithHashes(txn, func(hs *Hashes) error {
+		hash, err := hs.Get([]byte("hlen-pending-writes-deferred"))
+		assert.NoError(t, err)
+		_, err = hash.HSet([]byte("f"), []byte("v"))
+		assert.NoError(t, err)
+		l, exists, err := hash.HLenOrMissing()
+		assert.NoError(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, int64(1), l)
+		return nil
+	}))
+}
+
+func TestWithHashes(t *testing.T) {
+	keyA, keyB, keyC := []byte("with-hashes-a"), []byte("with-hashes-b"), []byte("with-hashes-c")
+	setHashFields(t, keyC, [][]byte{[]byte("x"), []byte("y")}, [][]byte{[]byte("1"), []byte("2")})
+	ops := func(hs *Hashes) error {
+		for _, key := range [][]byte{keyA, keyB, keyA} {
+			hash, err := hs.Get(key)
+			if err != nil {
+				return err
+			}
+			if _, err := hash.HSet([]byte(fmt.Sprintf("f%d", hash.HLen())), []byte("v")); err != nil {
+				return err
+			}
+		}
+		hash, err := hs.Get(keyC)
+		if err != nil {
+			return err
+		}
+		_, err = hash.HDel([][]byte{[]byte("x")})
+		return err
+	}
+	lens := func() []int64 {
+		txn, err := mockDB.Begin()
+		assert.NoError(t, err)
+		defer txn.Rollback()
+		var lens []int64
+		for _, key := range [][]byte{keyA, keyB, keyC} {
+			hash, err := txn.Hash(key)
+			assert.NoError(t, err)
+			lens = append(lens, hash.HLen())
+		}
+		return lens
+	}
+
+	// a failure leaves all the hashes unchanged
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	err = WithHashes(txn, func(hs *Hashes) error {
+		if err := ops(hs); err != nil {
+			return err
+		}
+		return errInjected
+	})
+	assert.Equal(t, errInjected, err)
+	assert.NoError(t, txn.Rollback())
+	assert.Equal(t, []int64{0, 0, 2}, lens())
+
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	metas := make(map[string]int)
+	txn.t = &faultTxn{Transaction: txn.t, set: func(t store.Transaction, k kv.Key, v []byte) error {
+		for _, key := range [][]byte{keyA, keyB, keyC} {
+			if bytes.Equal(k, MetaKey(mockDB, key)) {
+				metas[string(key)]++
+			}
+		}
+		return t.Set(k, v)
+	}}
+	assert.NoError(t, WithHashes(txn, ops))
+	assert.NoError(t, txn.Commit(context.TODO()))
+	assert.Equal(t, map[string]int{string(keyA): 1, string(keyB): 1, string(keyC): 1}, metas)
+	assert.Equal(t, []int64{2, 1, 1}, lens())
+}
+
+func TestWithHashesRecreate(t *testing.T) {
+	key := []byte("with-hashes-recreate")
+	setHashFields(t, key, [][]byte{[]byte("old")}, [][]byte{[]byte("1")})
+
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	assert.NoError(t, WithHashes(txn, func(hs *Hashes) error {
+		hash, err := hs.Get(key)
+		if err != nil {
+			return err
+		}
+		if _, err := hash.HDel([][]byte{[]byte("old")}); err != nil {
+			return err
+		}
+		hash, err = hs.Get(key)
+		if err != nil {
+			return err
+		}
+		_, err = hash.HSet([]byte("new"), []byte("2"))
+		return err
+	}))
+	assert.NoError(t, txn.Commit(context.TODO()))
+
+	// the fields written after the hash is destroyed survive the GC of its old data
+	assert.NoError(t, doGC(mockDB, 1000))
+	txn, err = mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash(key)
+	assert.NoError(t, err)
+	fields, values, err := hash.HGetAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("new")}, fields)
+	assert.Equal(t, [][]byte{[]byte("2")}, values)
+	assert.Equal(t, int64(1), hash.HLen())
+}
+
+func TestHashSelfCheck(t *testing.T) {
+	fields := [][]byte{[]byte("a"), []byte("b")}
+	cases := map[string]func(txn *Transaction, hash *Hash, dkey []byte){
+		"len": func(txn *Transaction, hash *Hash, dkey []byte) {
+			hash.meta.Len++
+		},
+		"bytes": func(txn *Transaction, hash *Hash, dkey []byte) {
+			hash.meta.Bytes--
+		},
+		"malformed key": func(txn *Transaction, hash *Hash, dkey []byte) {
+			assert.NoError(t, txn.t.Set(append(dkey, []byte("junk")...), []byte("x")))
+		},
+		"orphan sub key": func(txn *Transaction, hash *Hash, dkey []byte) {
+			assert.NoError(t, txn.t.Set(hashSubKey(dkey, hashSubVersion, []byte("gone")), []byte("12345678")))
+		},
+		"missing order": func(txn *Transaction, hash *Hash, dkey []byte) {
+			assert.NoError(t, txn.t.Delete(hashSubKey(dkey, hashSubOrderField, []byte("a"))))
+		},
+		"disabled feature": func(txn *Transaction, hash *Hash, dkey []byte) {
+			hash.meta.Flags &^= HashFlagVersioning
+		},
+		"inline entries": func(txn *Transaction, hash *Hash, dkey []byte) {
+			hash.meta.Inline = []inlineEntry{{K: []byte(":a"), V: []byte("a")}}
+		},
+	}
+	for name, inject := range cases {
+		txn, err := mockDB.Begin()
+		assert.NoError(t, err)
+		hash, err := txn.Hash([]byte("hash-self-check"))
+		assert.NoError(t, err)
+		_, err = hash.HSet(fields[0], []byte("v"))
+		assert.NoError(t, err)
+		assert.NoError(t, hash.EnableInsertionOrder())
+		assert.NoError(t, hash.EnableVersioning())
+		assert.NoError(t, hash.HMSet(fields, fields))
+		assert.Empty(t, hash.SelfCheck(), name)
+
+		inject(txn, hash, DataKey(txn.db, hash.meta.ID))
+		want := 1
+		if name == "disabled feature" {
+			// every version key is reported
+			want = len(fields)
+		}
+		assert.Len(t, hash.SelfCheck(), want, name)
+		assert.NoError(t, txn.Rollback())
+	}
+
+	// an inline hash must not leave keys in the store
+	SetInlineHashLimits(8, 256)
+	defer SetInlineHashLimits(0, 0)
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-self-check-inline"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet(fields, fields))
+	assert.Empty(t, hash.SelfCheck())
+	assert.NoError(t, txn.t.Set(hashItemKey(DataKey(txn.db, hash.meta.ID), []byte("a")), []byte("a")))
+	assert.Len(t, hash.SelfCheck(), 1)
+}
+
+func TestHDelIf(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hdelif"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")}))
+
+	deleted, err := hash.HDelIf([]byte("a"), []byte("x"))
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	deleted, err = hash.HDelIf([]byte("missing"), []byte("1"))
+	assert.NoError(t, err)
+	assert.False(t, deleted)
+	assert.Equal(t, int64(2), hash.HLen())
+
+	deleted, err = hash.HDelIf([]byte("a"), []byte("1"))
+	assert.NoError(t, err)
+	assert.True(t, deleted)
+	assert.Equal(t, int64(1), hash.HLen())
+	val, err := hash.HGet([]byte("a"))
+	assert.NoError(t, err)
+	assert.Nil(t, val)
+	assert.Empty(t, hash.SelfCheck())
+}
+
+func TestHashFreezeTimestamps(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hash-freeze-timestamps"))
+	assert.NoError(t, err)
+	assert.Equal(t, ErrKeyNotFound, hash.FreezeTimestamps())
+	_, err = hash.HSet([]byte("a"), []byte("1"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.FreezeTimestamps())
+	updated := hash.meta.UpdatedAt
+	etag, err := hash.ETag()
+	assert.NoError(t, err)
+
+	time.Sleep(time.Millisecond)
+	_, err = hash.HSet([]byte("b"), []byte("2"))
+	assert.NoError(t, err)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("a"), []byte("c")}, [][]byte{[]byte("x"), []byte("3")}))
+	_, err = hash.HDel([][]byte{[]byte("c")})
+	assert.NoError(t, err)
+	assert.Equal(t, updated, hash.meta.UpdatedAt)
+	assert.Equal(t, int64(2), hash.HLen())
+	val, err := hash.HGet([]byte("a"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("x"), val)
+
+	// the flag is kept in the meta
+	hash, err = txn.Hash([]byte("hash-freeze-timestamps"))
+	assert.NoError(t, err)
+	_, err = hash.HSet([]byte("d"), []byte("4"))
+	assert.NoError(t, err)
+	assert.Equal(t, updated, hash.meta.UpdatedAt)
+	tag, err := hash.ETag()
+	assert.NoError(t, err)
+	assert.NotEqual(t, etag, tag) // Len changed
+
+	assert.NoError(t, hash.UnfreezeTimestamps())
+	_, err = hash.HSet([]byte("d"), []byte("5"))
+	assert.NoError(t, err)
+	assert.True(t, hash.meta.UpdatedAt > updated)
+}
+
+func TestHGetAllPacked(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hgetall-packed"))
+	assert.NoError(t, err)
+
+	fields, buf, offsets, err := hash.HGetAllPacked()
+	assert.NoError(t, err)
+	assert.Empty(t, fields)
+	assert.Empty(t, buf)
+	assert.Equal(t, []int{0}, offsets)
+
+	assert.NoError(t, hash.HMSet(
+		[][]byte{[]byte("a"), []byte("b"), []byte("c")},
+		[][]byte{[]byte("1"), bytes.Repeat([]byte("x"), 1000), []byte("333")}))
+	assert.NoError(t, hash.EnableCompression())
+	want, wantVals, err := hash.HGetAll()
+	assert.NoError(t, err)
+	fields, buf, offsets, err = hash.HGetAllPacked()
+	assert.NoError(t, err)
+	assert.Equal(t, want, fields)
+	assert.Len(t, offsets, len(fields)+1)
+	for i := range fields {
+		assert.Equal(t, wantVals[i], buf[offsets[i]:offsets[i+1]])
+	}
+	assert.Equal(t, 1004, len(buf))
+}
+
+func TestDistinctValueCount(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("distinct-value-count"))
+	assert.NoError(t, err)
+	n, err := hash.DistinctValueCount(0)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), n)
+
+	var fields, vals [][]byte
+	for i := 0; i < 3000; i++ {
+		fields = append(fields, []byte(fmt.Sprintf("f%04d", i)))
+		vals = append(vals, []byte(strconv.Itoa(i%700)))
+	}
+	assert.NoError(t, hash.HMSet(fields, vals))
+
+	n, err = hash.DistinctValueCount(0)
+	assert.NoError(t, err)
+	assert.InDelta(t, 700, n, 700*0.03)
+	n, err = hash.DistinctValueCount(100)
+	assert.NoError(t, err)
+	assert.InDelta(t, 100, n, 100*0.03)
+}
+
+func TestHMaxMinField(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hmax-min-field"))
+	assert.NoError(t, err)
+	_, _, err = hash.HMaxField()
+	assert.Equal(t, ErrFieldNotFound, err)
+
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("name"), []byte("pi")}, [][]byte{[]byte("alice"), []byte("3.14")}))
+	_, _, err = hash.HMinField()
+	assert.Equal(t, ErrFieldNotFound, err)
+
+	assert.NoError(t, hash.HMSet(
+		[][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d"), []byte("e")},
+		[][]byte{[]byte("7"), []byte("-3"), []byte("42"), []byte("42"), []byte("-3")}))
+	field, n, err := hash.HMaxField()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("c"), field)
+	assert.Equal(t, int64(42), n)
+	field, n, err = hash.HMinField()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("b"), field)
+	assert.Equal(t, int64(-3), n)
+}
+
+// fakeRespWriter records the replies written to it
+type fakeRespWriter struct {
+	replies []string
+}
+
+func (w *fakeRespWriter) Array(size int) error {
+	w.replies = append(w.replies, "*"+strconv.Itoa(size))
+	return nil
+}
+
+func (w *fakeRespWriter) BulkString(s string) error {
+	w.replies = append(w.replies, "$"+s)
+	return nil
+}
+
+func TestHGetAllToResp(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hgetall-to-resp"))
+	assert.NoError(t, err)
+
+	w := &fakeRespWriter{}
+	assert.NoError(t, hash.HGetAllToResp(w))
+	assert.Equal(t, []string{"*0"}, w.replies)
+
+	assert.NoError(t, hash.HMSet(
+		[][]byte{[]byte("a"), []byte("b"), []byte("c")},
+		[][]byte{[]byte("1"), bytes.Repeat([]byte("x"), 1000), []byte("333")}))
+	assert.NoError(t, hash.EnableCompression())
+	fields, vals, err := hash.HGetAll()
+	assert.NoError(t, err)
+	want := &fakeRespWriter{}
+	want.Array(2 * len(fields))
+	for i := range fields {
+		want.BulkString(string(fields[i]))
+		want.BulkString(string(vals[i]))
+	}
+	w = &fakeRespWriter{}
+	assert.NoError(t, hash.HGetAllToResp(w))
+	assert.Equal(t, want.replies, w.replies)
+
+	// nothing is written when the fields found differ from Len or the store fails
+	w = &fakeRespWriter{}
+	hash.meta.Len = 2
+	assert.Equal(t, ErrLenMismatch, hash.HGetAllToResp(w))
+	hash.meta.Len = 4
+	assert.Equal(t, ErrLenMismatch, hash.HGetAllToResp(w))
+	hash.meta.Len = 3
+	txn.t = &faultTxn{Transaction: txn.t, seek: func(t store.Transaction, k kv.Key) (kv.Iterator, error) {
+		iter, err := t.Seek(k)
+		return &faultIter{Iterator: iter, n: 2}, err
+	}}
+	assert.Equal(t, errInjected, hash.HGetAllToResp(w))
+	assert.Empty(t, w.replies)
+}
+
+func TestHScanModifiedSince(t *testing.T) {
+	txn, err := mockDB.Begin()
+	assert.NoError(t, err)
+	defer txn.Rollback()
+	hash, err := txn.Hash([]byte("hscan-modified-since"))
+	assert.NoError(t, err)
+	_, _, err = hash.HScanModifiedSince(0, 0)
+	assert.Equal(t, ErrFieldTimesDisabled, err)
+	assert.Equal(t, ErrKeyNotFound, hash.EnableFieldTimestamps())
+
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("a"), []byte("b")}, [][]byte{[]byte("1"), []byte("2")}))
+	assert.NoError(t, hash.EnableFieldTimestamps())
+	_, err = hash.HSet([]byte("d"), []byte("4"))
+	assert.NoError(t, err)
+	time.Sleep(time.Millisecond)
+	ts := Now()
+	time.Sleep(time.Millisecond)
+	assert.NoError(t, hash.HMSet([][]byte{[]byte("c"), []byte("a")}, [][]byte{[]byte("3"), []byte("x")}))
+	_, err = hash.HIncrBy([]byte("e"), 5)
+	assert.NoError(t, err)
+	_, err = hash.HDel([][]byte{[]byte("e")})
+	assert.NoError(t, err)
+
+	fields, vals, err := hash.HScanModifiedSince(ts, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("c")}, fields)
+	assert.Equal(t, [][]byte{[]byte("x"), []byte("3")}, vals)
+	fields, _, err = hash.HScanModifiedSince(ts, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("a")}, fields)
+	fields, _, err = hash.HScanModifiedSince(0, 0)
+	assert.NoError(t, err)
+	assert.Len(t, fields, 4)
+	fields, _, err = hash.HScanModifiedSince(Now(), 0)
+	assert.NoError(t, err)
+	assert.Empty(t, fields)
+	assert.Empty(t, hash.SelfCheck())
+}
@@ -0,0 +1,114 @@
+package db
+
+import (
+	"bytes"
+)
+
+// EnableUniqueValues forbids two fields of the hash to hold the same value from now on, a write giving a field
+// the value of another field fails with ErrDuplicateValue. The values are indexed under sub keys mapping every
+// value to its field, the existing fields are indexed when it is enabled and it fails with ErrDuplicateValue if
+// they already have duplicated values. As the values become keys they should be short, and every write costs
+// one more read and two more writes. It fails with ErrKeyNotFound if the hash does not exist
+func (hash *Hash) EnableUniqueValues() error {
+	if hash.rawMeta == nil && !hash.metaDirty {
+		return ErrKeyNotFound
+	}
+	if hash.meta.Flags&HashFlagUniqueValues != 0 {
+		return nil
+	}
+	fields, vals, err := hash.HGetAll()
+	if err != nil {
+		return err
+	}
+	seen := make(map[string][]byte, len(fields))
+	for i := range fields {
+		if other, ok := seen[string(vals[i])]; ok {
+			return &FieldError{Field: other, Err: ErrDuplicateValue}
+		}
+		seen[string(vals[i])] = fields[i]
+	}
+	hash.meta.Flags |= HashFlagUniqueValues
+	for i := range fields {
+		if err := hash.valueIndexed(fields[i], nil, vals[i]); err != nil {
+			return err
+		}
+	}
+	return hash.updateMeta()
+}
+
+// checkUniqueValues returns ErrDuplicateValue if setting fields to vals gives a value to two fields, the
+// fields rewritten by the same call release their current values
+func (hash *Hash) checkUniqueValues(fields, vals [][]byte) error {
+	if hash.meta.Flags&HashFlagUniqueValues == 0 {
+		return nil
+	}
+	written := make(map[string][]byte, len(fields))
+	for i := range fields {
+		written[string(fields[i])] = vals[i]
+	}
+	owners := make(map[string][]byte, len(fields))
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	for i := range fields {
+		if vals[i] == nil {
+			continue
+		}
+		if other, ok := owners[string(vals[i])]; ok && !bytes.Equal(other, fields[i]) {
+			return &FieldError{Field: fields[i], Err: ErrDuplicateValue}
+		}
+		owners[string(vals[i])] = fields[i]
+
+		owner, err := hash.r().Get(hashSubKey(dkey, hashSubValue, vals[i]))
+		if err != nil {
+			if IsErrNotFound(err) {
+				continue
+			}
+			return err
+		}
+		if bytes.Equal(owner, fields[i]) {
+			continue
+		}
+		if val, ok := written[string(owner)]; ok && !bytes.Equal(val, vals[i]) {
+			continue
+		}
+		return &FieldError{Field: fields[i], Err: ErrDuplicateValue}
+	}
+	return nil
+}
+
+// valueIndexed moves field from old to val in the index of values, a nil value means the field is missing.
+// The uniqueness is checked by checkUniqueValues before the write
+func (hash *Hash) valueIndexed(field, old, val []byte) error {
+	if hash.meta.Flags&HashFlagUniqueValues == 0 || bytes.Equal(old, val) {
+		return nil
+	}
+	dkey := DataKey(hash.txn.db, hash.meta.ID)
+	if old != nil {
+		// the value may have been taken over by another field of the same call
+		okey := hashSubKey(dkey, hashSubValue, old)
+		owner, err := hash.r().Get(okey)
+		if err != nil && !IsErrNotFound(err) {
+			return err
+		}
+		if err == nil && bytes.Equal(owner, field) {
+			if err := hash.delete(okey); err != nil {
+				return err
+			}
+		}
+	}
+	if val != nil {
+		return hash.set(hashSubKey(dkey, hashSubValue, val), field)
+	}
+	return nil
+}
+
+// valueRemoved removes field holding the stored value raw from the index of values
+func (hash *Hash) valueRemoved(field, raw []byte) error {
+	if hash.meta.Flags&HashFlagUniqueValues == 0 {
+		return nil
+	}
+	old, err := decodeHashValue(hash.meta.Flags, raw)
+	if err != nil {
+		return err
+	}
+	return hash.valueIndexed(field, old, nil)
+}
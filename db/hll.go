@@ -0,0 +1,53 @@
+package db
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// hllPrecision is the number of bits of a hash choosing the register, the standard error of the estimate
+// is 1.04/sqrt(2^hllPrecision), about 0.8%
+const hllPrecision = 14
+
+// hll is a HyperLogLog counting the distinct values added to it
+type hll struct {
+	registers [1 << hllPrecision]uint8
+}
+
+// add adds val to the counted values
+func (h *hll) add(val []byte) {
+	f := fnv.New64a()
+	f.Write(val)
+	// fnv leaves the high bits of short inputs poorly mixed, so the sum is finalized as in splitmix64
+	x := f.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	idx := x >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(x<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// count returns the estimated number of distinct values added
+func (h *hll) count() int64 {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	// linear counting is more accurate while many registers are still empty
+	if est <= 2.5*m && zeros != 0 {
+		est = m * math.Log(m/float64(zeros))
+	}
+	return int64(est + 0.5)
+}
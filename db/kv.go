@@ -152,6 +152,7 @@ func (kv *Kv) FlushDB() error {
 	if err != nil {
 		return err
 	}
+	defer iter.Close()
 	for iter.Valid() && iter.Key().HasPrefix(prefix) {
 		if err := txn.Delete(iter.Key()); err != nil {
 			return err
@@ -172,6 +173,7 @@ func (kv *Kv) FlushAll() error {
 	if err != nil {
 		return err
 	}
+	defer iter.Close()
 	for iter.Valid() && iter.Key().HasPrefix(prefix) {
 		if err := txn.Delete(iter.Key()); err != nil {
 			return err
@@ -200,6 +202,7 @@ func (kv *Kv) RandomKey() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer iter.Close()
 
 	if iter.Valid() && iter.Key().HasPrefix(prefix) {
 		return iter.Key()[len(prefix):], nil
@@ -210,6 +213,7 @@ func (kv *Kv) RandomKey() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer iter.Close()
 
 	if iter.Valid() && iter.Key().HasPrefix(prefix) {
 		return iter.Key()[len(prefix):], nil
@@ -212,6 +212,7 @@ func (l *LList) LPop() (data []byte, err error) {
 	if err != nil {
 		return nil, err
 	}
+	defer iter.Close()
 	if !iter.Valid() || !iter.Key().HasPrefix(l.rawDataKeyPrefix) {
 		return nil, ErrKeyNotFound
 	}
@@ -251,6 +252,7 @@ func (l *LList) RPop() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer iter.Close()
 	if !iter.Valid() || !iter.Key().HasPrefix(l.rawDataKeyPrefix) {
 		return nil, ErrKeyNotFound
 	}
@@ -377,6 +379,7 @@ func (l *LList) remove(start float64, n int64) (float64, error) {
 	if err != nil {
 		return 0, err
 	}
+	defer iter.Close()
 	for iter.Valid() && iter.Key().HasPrefix(l.rawDataKeyPrefix) && n != 0 {
 		if err := l.txn.t.Delete(iter.Key()); err != nil {
 			return 0, err
@@ -464,6 +467,7 @@ func (l *LList) LRem(v []byte, n int64) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	defer iter.Close()
 	if !iter.Valid() || !iter.Key().HasPrefix(l.rawDataKeyPrefix) {
 		return 0, ErrKeyNotFound
 	}
@@ -474,6 +478,7 @@ func (l *LList) LRem(v []byte, n int64) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	defer iter.Close()
 	if !iter.Valid() || !iter.Key().HasPrefix(l.rawDataKeyPrefix) {
 		return 0, ErrKeyNotFound
 	}
@@ -497,6 +502,9 @@ func (l *LList) indexValueN(v []byte, n int64) (realidxs []float64, err error) {
 	} else {
 		n = l.Len
 	}
+	if iter != nil {
+		defer iter.Close()
+	}
 
 	// for loop iterate all objects and check if valid until reach pivot value
 	for count := int64(0); count < n && err == nil && iter.Valid() && iter.Key().HasPrefix(l.rawDataKeyPrefix); err = iter.Next() {
@@ -516,6 +524,7 @@ func (l *LList) indexValue(v []byte) (realidxs []float64, err error) {
 	if err != nil { // dup
 		return nil, err
 	}
+	defer iter.Close()
 
 	flag := false //if we find the v key
 	rawDataKeyPrefixLen := len(l.rawDataKeyPrefix)
@@ -563,6 +572,10 @@ func (l *LList) scan(left, right int64) (realidxs []float64, values [][]byte, er
 	// seek start indecate the seek first key start time.
 	start := time.Now()
 	iter, err := l.txn.t.Seek(append(l.rawDataKeyPrefix, EncodeFloat64(l.LListMeta.Lindex)...))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer iter.Close()
 
 	var idx int64
 	// for loop iterate all objects to get the next data object and check if valid
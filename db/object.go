@@ -11,6 +11,9 @@ const (
 	ObjectEncodingLength = 42
 )
 
+// the segments of data keys are split by a single byte, the index is out of range and fails to compile otherwise
+var _ = [1]struct{}{}[len(Separator)-1]
+
 // ObjectEncoding is the encoding type of an object
 type ObjectEncoding byte
 
@@ -26,6 +29,7 @@ const (
 	ObjectEncodingSkiplist
 	ObjectEncodingEmbstr
 	ObjectEncodingQuicklist
+	ObjectEncodingListpack
 )
 
 // String representation of ObjectEncoding
@@ -51,6 +55,8 @@ func (enc ObjectEncoding) String() string {
 		return "embstr"
 	case ObjectEncodingQuicklist:
 		return "quicklist"
+	case ObjectEncodingListpack:
+		return "listpack"
 	default:
 		return "unknown"
 	}
@@ -50,8 +50,10 @@ func GetSet(txn *Transaction, key []byte) (*Set, error) {
 }
 
 func setItemKey(key []byte, member []byte) []byte {
-	key = append(key, ':')
-	return append(key, member...)
+	ikey := make([]byte, 0, len(key)+1+len(member))
+	ikey = append(ikey, key...)
+	ikey = append(ikey, ':')
+	return append(ikey, member...)
 }
 
 func (set *Set) updateMeta() error {
@@ -106,6 +108,7 @@ func (set *Set) SMembers() ([][]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	defer iter.Close()
 
 	for iter.Valid() && iter.Key().HasPrefix(prefix) && count != 0 {
 		members = append(members, iter.Key()[len(prefix):])
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pingcap/tidb/kv"
+)
+
+// MemTxn is an in-memory Transaction without a storage behind it, it keeps the entries sorted by key so it
+// iterates like a transaction of TiKV. It is meant for unit tests, the snapshot of a MemTxn is the MemTxn
+// itself and Commit only ends the transaction
+type MemTxn struct {
+	SortedKV
+	written  bool
+	finished bool
+}
+
+// NewMemTxn returns an empty MemTxn
+func NewMemTxn() *MemTxn {
+	return &MemTxn{}
+}
+
+// Clone returns a new MemTxn holding the entries of t, the writes to either of them are not seen by the other
+func (t *MemTxn) Clone() *MemTxn {
+	return &MemTxn{SortedKV: SortedKV{Entries: t.Entries}}
+}
+
+// BatchGet gets the values of keys, the missing keys are absent in the result
+func (t *MemTxn) BatchGet(keys []kv.Key) (map[string][]byte, error) {
+	vals := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		val, err := t.Get(k)
+		if err != nil {
+			if kv.IsErrNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+		vals[string(k)] = val
+	}
+	return vals, nil
+}
+
+// Set sets the value for key k, v must not be empty
+func (t *MemTxn) Set(k kv.Key, v []byte) error {
+	if err := t.SortedKV.Set(k, v); err != nil {
+		return err
+	}
+	t.written = true
+	return nil
+}
+
+// Delete removes the entry for key k
+func (t *MemTxn) Delete(k kv.Key) error {
+	t.written = true
+	return t.SortedKV.Delete(k)
+}
+
+// Size returns the sum of the lengths of the keys and values
+func (t *MemTxn) Size() int {
+	size := 0
+	for _, e := range t.Entries {
+		size += len(e.K) + len(e.V)
+	}
+	return size
+}
+
+// Len returns the number of entries
+func (t *MemTxn) Len() int { return len(t.Entries) }
+
+// Reset removes all entries
+func (t *MemTxn) Reset() {
+	t.Entries, t.written = nil, false
+}
+
+// SetCap does nothing, the entries grow as needed
+func (t *MemTxn) SetCap(cap int) {}
+
+// Commit ends the transaction, the entries stay readable
+func (t *MemTxn) Commit(context.Context) error {
+	if t.finished {
+		return kv.ErrInvalidTxn
+	}
+	t.finished = true
+	return nil
+}
+
+// Rollback ends the transaction
+func (t *MemTxn) Rollback() error {
+	if t.finished {
+		return kv.ErrInvalidTxn
+	}
+	t.finished = true
+	return nil
+}
+
+func (t *MemTxn) String() string {
+	return fmt.Sprintf("MemTxn(%d entries)", len(t.Entries))
+}
+
+// LockKeys does nothing as there is no other transaction to conflict with
+func (t *MemTxn) LockKeys(keys ...kv.Key) error { return nil }
+
+// SetOption ignores the options
+func (t *MemTxn) SetOption(opt kv.Option, val interface{}) {}
+
+// DelOption ignores the options
+func (t *MemTxn) DelOption(opt kv.Option) {}
+
+// IsReadOnly returns if nothing has been written
+func (t *MemTxn) IsReadOnly() bool { return !t.written }
+
+// StartTS returns 0 as there is no timestamp oracle
+func (t *MemTxn) StartTS() uint64 { return 0 }
+
+// Valid returns if the transaction is neither committed nor rolled back
+func (t *MemTxn) Valid() bool { return !t.finished }
+
+// GetMemBuffer returns the transaction itself, all entries are buffered
+func (t *MemTxn) GetMemBuffer() kv.MemBuffer { return t }
+
+// GetSnapshot returns the transaction itself, there is no storage to read from
+func (t *MemTxn) GetSnapshot() kv.Snapshot { return t }
+
+// SetPriority ignores the priority
+func (t *MemTxn) SetPriority(priority int) {}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pingcap/tidb/kv"
+	"github.com/stretchr/testify/assert"
+)
+
+var _ Transaction = (*MemTxn)(nil)
+
+func memKeys(t *testing.T, iter kv.Iterator) []string {
+	defer iter.Close()
+	var keys []string
+	for iter.Valid() {
+		keys = append(keys, string(iter.Key()))
+		assert.NoError(t, iter.Next())
+	}
+	return keys
+}
+
+func TestMemTxnIterate(t *testing.T) {
+	txn := NewMemTxn()
+	for _, k := range []string{"b", "d", "a", "c", "ab"} {
+		assert.NoError(t, txn.Set(kv.Key(k), []byte("v"+k)))
+	}
+	assert.NoError(t, txn.Set(kv.Key("c"), []byte("c2")))
+	assert.Equal(t, kv.ErrCannotSetNilValue, txn.Set(kv.Key("e"), nil))
+	assert.Equal(t, 5, txn.Len())
+
+	iter, err := txn.Seek(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "ab", "b", "c", "d"}, memKeys(t, iter))
+	iter, err = txn.Seek(kv.Key("aa"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ab", "b", "c", "d"}, memKeys(t, iter))
+	iter, err = txn.SeekReverse(kv.Key("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b", "ab", "a"}, memKeys(t, iter))
+	iter, err = txn.SeekReverse(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"d", "c", "b", "ab", "a"}, memKeys(t, iter))
+
+	// an iterator keeps the entries it was created on
+	iter, err = txn.Seek(nil)
+	assert.NoError(t, err)
+	assert.NoError(t, txn.Delete(kv.Key("b")))
+	assert.NoError(t, txn.Set(kv.Key("bb"), []byte("vbb")))
+	assert.Equal(t, []string{"a", "ab", "b", "c", "d"}, memKeys(t, iter))
+	iter, err = txn.Seek(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "ab", "bb", "c", "d"}, memKeys(t, iter))
+
+	val, err := txn.Get(kv.Key("c"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("c2"), val)
+	_, err = txn.Get(kv.Key("b"))
+	assert.True(t, IsErrNotFound(err))
+}
+
+func TestMemTxnBatchGet(t *testing.T) {
+	txn := NewMemTxn()
+	vals, err := BatchGetValues(txn, [][]byte{[]byte("a")})
+	assert.NoError(t, err)
+	assert.Empty(t, vals)
+
+	assert.NoError(t, txn.Set(kv.Key("a"), []byte("1")))
+	assert.NoError(t, txn.Set(kv.Key("b"), []byte("2")))
+	assert.NoError(t, txn.Delete(kv.Key("b")))
+	vals, err = BatchGetValues(txn, [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("a")})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"a": []byte("1")}, vals)
+	assert.Equal(t, 2, txn.Size())
+
+	assert.True(t, txn.Valid())
+	assert.NoError(t, txn.Commit(context.TODO()))
+	assert.False(t, txn.Valid())
+	assert.Error(t, txn.Rollback())
+}
@@ -0,0 +1,99 @@
+package store
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/pingcap/tidb/kv"
+)
+
+// Entry is a key and its value kept by a SortedKV
+type Entry struct {
+	K []byte
+	V []byte
+}
+
+// SortedKV keeps entries sorted by key in memory and reads and writes them like a transaction of TiKV.
+// Every write replaces Entries, so the iterators keep reading the entries they were created on
+type SortedKV struct {
+	Entries []Entry
+}
+
+func (s *SortedKV) search(k []byte) int {
+	return sort.Search(len(s.Entries), func(i int) bool {
+		return bytes.Compare(s.Entries[i].K, k) >= 0
+	})
+}
+
+// Get gets the value for key k, it returns kv.ErrNotExist if k is missing
+func (s *SortedKV) Get(k kv.Key) ([]byte, error) {
+	i := s.search(k)
+	if i < len(s.Entries) && bytes.Equal(s.Entries[i].K, k) {
+		return s.Entries[i].V, nil
+	}
+	return nil, kv.ErrNotExist
+}
+
+// Seek returns an iterator positioned on the first entry whose key is not less than k
+func (s *SortedKV) Seek(k kv.Key) (kv.Iterator, error) {
+	return &sortedIter{entries: s.Entries, i: s.search(k)}, nil
+}
+
+// SeekReverse returns a reversed iterator positioned on the last entry whose key is less than k,
+// or on the last entry if k is nil
+func (s *SortedKV) SeekReverse(k kv.Key) (kv.Iterator, error) {
+	i := len(s.Entries)
+	if k != nil {
+		i = s.search(k)
+	}
+	return &sortedIter{entries: s.Entries, i: i - 1, reverse: true}, nil
+}
+
+// Set sets the value for key k, v must not be empty
+func (s *SortedKV) Set(k kv.Key, v []byte) error {
+	if len(v) == 0 {
+		return kv.ErrCannotSetNilValue
+	}
+	i := s.search(k)
+	entries := make([]Entry, 0, len(s.Entries)+1)
+	entries = append(entries, s.Entries[:i]...)
+	entries = append(entries, Entry{K: append([]byte{}, k...), V: append([]byte{}, v...)})
+	if i < len(s.Entries) && bytes.Equal(s.Entries[i].K, k) {
+		i++
+	}
+	s.Entries = append(entries, s.Entries[i:]...)
+	return nil
+}
+
+// Delete removes the entry for key k
+func (s *SortedKV) Delete(k kv.Key) error {
+	i := s.search(k)
+	if i == len(s.Entries) || !bytes.Equal(s.Entries[i].K, k) {
+		return nil
+	}
+	entries := make([]Entry, 0, len(s.Entries)-1)
+	entries = append(entries, s.Entries[:i]...)
+	s.Entries = append(entries, s.Entries[i+1:]...)
+	return nil
+}
+
+// sortedIter iterates the entries of a SortedKV
+type sortedIter struct {
+	entries []Entry
+	i       int
+	reverse bool
+}
+
+func (it *sortedIter) Valid() bool   { return it.i >= 0 && it.i < len(it.entries) }
+func (it *sortedIter) Key() kv.Key   { return kv.Key(it.entries[it.i].K) }
+func (it *sortedIter) Value() []byte { return it.entries[it.i].V }
+func (it *sortedIter) Close()        {}
+
+func (it *sortedIter) Next() error {
+	if it.reverse {
+		it.i--
+	} else {
+		it.i++
+	}
+	return nil
+}
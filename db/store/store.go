@@ -16,6 +16,10 @@ type (
 	Transaction kv.Transaction
 	// Iterator is the interface for a iterator on KV store.
 	Iterator kv.Iterator
+	// Snapshot defines the interface for the snapshot fetched from storage.
+	Snapshot kv.Snapshot
+	// Retriever is the interface wraps the basic Get and Seek methods.
+	Retriever kv.Retriever
 )
 
 //Open create tikv db ,create fake db if addr contains mockaddr
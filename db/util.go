@@ -6,6 +6,9 @@ import (
 	"github.com/satori/go.uuid"
 )
 
+// uuidLen is the length of the object IDs allocated by UUID
+const uuidLen = uuid.Size
+
 // UUID allocates an unique object ID.
 func UUID() []byte { return uuid.NewV4().Bytes() }
 
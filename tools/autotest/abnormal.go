@@ -14,6 +14,7 @@ type Abnormal struct {
 	ek   *cmd.ExampleKey
 	ess  *cmd.ExampleSystem
 	em   *cmd.ExampleMulti
+	eh   *cmd.ExampleHash
 	conn redis.Conn
 }
 
@@ -38,6 +39,7 @@ func (an *Abnormal) Start(addr string) {
 	an.el = cmd.NewExampleList(conn)
 	an.ess = cmd.NewExampleSystem(conn)
 	an.em = cmd.NewExampleMulti(conn)
+	an.eh = cmd.NewExampleHash(conn)
 }
 
 //Close close annormal client
@@ -132,6 +134,17 @@ func (an *Abnormal) KeyCase(t *testing.T) {
 	an.ek.TTLEqualErr(t, "ERR wrong number of arguments for 'ttl' command", "heng", "heng")
 }
 
+//HashCase check that a retried hset is counted once
+func (an *Abnormal) HashCase(t *testing.T) {
+	an.eh.HSetEqual(t, 1, "hash-retry", "field", "v")
+	an.eh.HLenEqual(t, 1, "hash-retry")
+	an.eh.HSetEqual(t, 0, "hash-retry", "field", "v")
+	an.eh.HLenEqual(t, 1, "hash-retry")
+	an.eh.HSetEqual(t, 0, "hash-retry", "field", "v2")
+	an.eh.HLenEqual(t, 1, "hash-retry")
+	an.ek.DelEqual(t, 1, "hash-retry")
+}
+
 //SystemCase check system case
 func (an *Abnormal) SystemCase(t *testing.T) {
 	an.ess.PingEqualErr(t, "ERR wrong number of arguments for 'ping' command", "ping", "hello", "fuck")
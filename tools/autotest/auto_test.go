@@ -15,4 +15,5 @@ func Test(t *testing.T) {
 	an.ListCase(t)
 	an.KeyCase(t)
 	an.MultiCase(t)
+	an.HashCase(t)
 }
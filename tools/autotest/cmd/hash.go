@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/stretchr/testify/assert"
+)
+
+//ExampleHash verify the hash command
+type ExampleHash struct {
+	conn redis.Conn
+}
+
+//NewExampleHash create hash object
+func NewExampleHash(conn redis.Conn) *ExampleHash {
+	return &ExampleHash{
+		conn: conn,
+	}
+}
+
+//HSetEqual verify that the return value of the hset operation is correct
+func (eh *ExampleHash) HSetEqual(t *testing.T, expectReply int, key, field, value string) {
+	reply, err := redis.Int(eh.conn.Do("hset", key, field, value))
+	assert.Equal(t, expectReply, reply)
+	assert.NoError(t, err)
+}
+
+//HLenEqual verify that the return value of the hlen operation is correct
+func (eh *ExampleHash) HLenEqual(t *testing.T, expectReply int, key string) {
+	reply, err := redis.Int(eh.conn.Do("hlen", key))
+	assert.Equal(t, expectReply, reply)
+	assert.NoError(t, err)
+}